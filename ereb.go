@@ -4,7 +4,9 @@ import (
 	"net/http"
 
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
 	"github.com/influxdata/telegraf/plugins/inputs"
+	"github.com/robfig/cron/v3"
 	"strings"
 	"encoding/json"
 	"time"
@@ -13,15 +15,168 @@ import (
 	"fmt"
 	"strconv"
 	"log"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"errors"
+	"os"
+	"bytes"
+	"crypto/md5"
+	crand "crypto/rand"
+	"encoding/hex"
+	"crypto/tls"
+	"context"
+	"net"
+	"net/http/httptrace"
+	"path/filepath"
+	"unicode/utf8"
 )
 
-type ereb struct {
+// Ereb gathers metrics from one or more ereb schedulers. Use New to get an
+// instance with the same defaults as the Telegraf registration.
+type Ereb struct {
 	Servers []string
+	DefaultServer string
+	RequireServers bool
+	ServerConfigs []ServerConfig `toml:"server"`
+	ServersFile string
+	BasePaths []string
+	StatusPath string
+	TasksPath string
+	RecentRunsPath string
+	StatusFields []string
+	DigestAuth bool
+	NetrcFile string
+	ForceHTTP1 bool
+	FollowRedirects bool
+	RequestMethod string
+	RequestBody string
+	Timeout config.Duration
+	MaxIdleConns int
+	IdleConnTimeout config.Duration
+	MaxBodySize config.Size
+	Retries int
+	RetryableStatusCodes []int
+	RetryNonIdempotent bool
+	LegacyDurationFields bool
+	DurationSummaryField bool
+	UseServerTime bool
+	MaxRecentRuns int
+	HealthCheckOnly bool
+	GatherInternalMetrics bool
+	Trace bool
+	FleetSummary bool
+	FailureLogs bool
+	FailureLogSize config.Size
+	ScrapeJitter config.Duration
+	ImminentWindow config.Duration
+	StallThreshold int
+	Collectors []string
+	IncludeDisabledTasks bool
+	RequireStats bool
+	ErrorThreshold int64
+	DurationEmaFactor float64
+	FieldRename map[string]string
+	RealmCredentials map[string]RealmCredentials
+	LegacyValueField bool
+	VersionTag bool
+	VersionTagTasks bool
+	SchedulerStateTag bool
+	RecentExitCodeFields int
+
+	// basePath is the base path found to work for each server address
+	basePath   map[string]string
+	basePathMu sync.Mutex
+
+	// cache holds the last response of each URL that came with an ETag
+	cache   map[string]cachedResponse
+	cacheMu sync.Mutex
+
+	// netrc holds the credentials of the netrc file by machine, "" standing
+	// for the default entry
+	netrc map[string]netrcEntry
+
+	// taskIDs holds the task IDs of the previous gather of each server
+	taskIDs   map[string]map[string]bool
+	taskIDsMu sync.Mutex
+
+	// nextRuns holds the last next_run of each server and for how many
+	// gathers in a row it stayed the same
+	nextRuns   map[string]nextRunHistory
+	nextRunsMu sync.Mutex
+
+	// durationEma holds the moving average of the max duration of each
+	// task, by server address and task ID
+	durationEma   map[string]map[string]float64
+	durationEmaMu sync.Mutex
 	debug_mode bool
-	client *http.Client
+
+	// Client is used for all requests when set, otherwise a client honoring
+	// Timeout is created on first use. Only the default client can reach
+	// unix:// servers, which are rejected along with a custom one.
+	Client     *http.Client `toml:"-"`
+	client     *http.Client
+	clientOnce sync.Once
+}
+
+// ServerConfig is a server given as a table, with its own credentials.
+type ServerConfig struct {
+	URL         string
+	Username    string
+	Password    config.Secret
+	BearerToken config.Secret
+	// Timeout overrides the plugin timeout for this server when set
+	Timeout config.Duration
+}
+
+// RealmCredentials are the basic auth credentials for one realm.
+type RealmCredentials struct {
+	Username string
+	Password config.Secret
+}
+
+// server is a parsed server address along with the credentials to use for it.
+// A new one is built on every gather, so it also holds responses shared by
+// the gather functions during that gather.
+type server struct {
+	url      *url.URL
+	username string
+	password string
+	token    string
+	timeout  time.Duration
+	// socket is the path of the Unix socket of a unix:// address
+	socket string
+
+	// redirected is the URL requests were last redirected to
+	redirected *url.URL
+	redirectMu sync.Mutex
+
+	// acc receives the request metrics of this gather
+	acc telegraf.Accumulator
+	// fleet collects the totals of all servers of this gather
+	fleet *fleetTotals
+	// ctx bounds the requests of this gather by the server timeout, counted
+	// from before the jitter
+	ctx context.Context
+
+	statusOnce   sync.Once
+	status       ErebStatus
+	statusFields map[string]interface{}
+	statusErr    error
+
+	tasksOnce sync.Once
+	tasks     ErebTasks
+	tasksErr  error
+	// tasksCount is the count newer servers send along with the tasks
+	tasksCount *int
+	// tasksReported is set when gatherTasks runs in this gather, reporting
+	// the /tasks error for all gather functions
+	tasksReported bool
 }
 
 type ErebStatus struct {
+	// Seconds until the next planned run, negative when it is overdue.
+	// Emitted unchanged as next_run_in, so servers compare as they are.
 	NextRun   float64 `json:"next_run"`
 	NextTasks []struct {
 		Cmd            string        `json:"cmd"`
@@ -30,13 +185,43 @@ type ErebStatus struct {
 		Enabled        bool          `json:"enabled"`
 		Group          string        `json:"group"`
 		Name           string        `json:"name"`
-		ShellScripts   []interface{} `json:"shell_scripts"`
+		ShellScripts   []ShellScript `json:"shell_scripts"`
 		TaskID         string        `json:"task_id"`
 		Timeout        string        `json:"timeout"`
 		TryMoreOnError bool          `json:"try_more_on_error"`
 	} `json:"next_tasks"`
 	PlannedTaskRunUuids []string `json:"planned_task_run_uuids"`
 	State               string   `json:"state"`
+	// Reported by newer ereb versions only
+	StartedAt *float64 `json:"started_at"`
+	Uptime    *float64 `json:"uptime"`
+	RunningTaskRuns []struct {
+		TaskRunUUID string  `json:"uuid"`
+		TaskID      string  `json:"task_id"`
+		Name        string  `json:"name"`
+		StartedAt   float64 `json:"started_at"`
+	} `json:"running_task_runs"`
+	PlannedTaskRuns []struct {
+		TaskRunUUID string  `json:"uuid"`
+		TaskID      string  `json:"task_id"`
+		PlannedAt   float64 `json:"planned_at"`
+	} `json:"planned_task_runs"`
+	// Unix time the server produced this status at
+	GeneratedAt *float64 `json:"generated_at"`
+	// Empty for servers too old to report it
+	Version string `json:"version"`
+	// Set by ereb versions reporting a pause apart from the state
+	Paused *bool `json:"paused"`
+}
+
+// metricTime returns the time to stamp the metrics of a status with: when
+// use_server_time is set, the time the server produced it at, if reported,
+// and the local time otherwise.
+func (g *Ereb) metricTime(st *ErebStatus) time.Time {
+	if !g.UseServerTime || st.GeneratedAt == nil || *st.GeneratedAt <= 0 {
+		return time.Now()
+	}
+	return time.Unix(0, int64(*st.GeneratedAt*float64(time.Second)))
 }
 
 type ErebTasks []struct {
@@ -46,227 +231,2426 @@ type ErebTasks []struct {
 	Enabled      bool          `json:"enabled"`
 	Group        string        `json:"group"`
 	Name         string        `json:"name"`
-	ShellScripts []interface{} `json:"shell_scripts"`
+	ShellScripts []ShellScript `json:"shell_scripts"`
 	Stats        struct {
-		DurationAvg float64  `json:"duration_avg"`
-		DurationMax int64    `json:"duration_max"`
-		DurationMin int64    `json:"duration_min"`
+		// Durations are null for tasks that never ran
+		DurationAvg *float64 `json:"duration_avg"`
+		DurationMax *int64   `json:"duration_max"`
+		DurationMin *int64   `json:"duration_min"`
+		// Percentiles, reported by some ereb builds only
+		DurationP50 *float64 `json:"duration_p50"`
+		DurationP95 *float64 `json:"duration_p95"`
+		DurationP99 *float64 `json:"duration_p99"`
 		Error       int64    `json:"error"`
 		ExitCodes   []string `json:"exit_codes"`
 		Success     int64    `json:"success"`
 		TaskID      string   `json:"task_id"`
+		// Unix time the last run started, missing on older ereb versions
+		LastRun *float64 `json:"last_run"`
 	} `json:"stats"`
 	TaskID         string `json:"task_id"`
 	Timeout        string `json:"timeout"`
 	TryMoreOnError bool   `json:"try_more_on_error"`
 }
 
-type gatherFunc func(g *ereb, serverAddr string, acc telegraf.Accumulator) error
-var gatherFunctions = []gatherFunc{gatherStatus, gatherTasks}
+// ShellScript is a script of a task. ereb sends either the bare script,
+// always enabled, or an object such as {"name": "backup.sh", "enabled": false}.
+// The object may name the script with "script" instead, and is enabled when
+// it does not say otherwise.
+type ShellScript struct {
+	Name    string
+	Enabled bool
+}
+
+func (sc *ShellScript) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*sc = ShellScript{Name: name, Enabled: true}
+		return nil
+	}
+
+	var object struct {
+		Name    string `json:"name"`
+		Script  string `json:"script"`
+		Enabled *bool  `json:"enabled"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		// Any other shape is kept as it is rather than failing all of /tasks
+		*sc = ShellScript{Name: string(data), Enabled: true}
+		return nil
+	}
+	*sc = ShellScript{Name: object.Name, Enabled: object.Enabled == nil || *object.Enabled}
+	if sc.Name == "" {
+		sc.Name = object.Script
+	}
+	return nil
+}
+
+type ErebRecentRuns []struct {
+	TaskID      string  `json:"task_id"`
+	Name        string  `json:"name"`
+	TaskRunUUID string  `json:"uuid"`
+	ExitCode    string  `json:"exit_code"`
+	Duration    float64 `json:"duration"`
+	StartedAt   float64 `json:"started_at"`
+	FinishedAt  float64 `json:"finished_at"`
+}
+
+// ConnectError is returned when an ereb server cannot be reached.
+type ConnectError struct {
+	URL string
+	Err error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("Unable to connect to ereb server '%s': %s", e.URL, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError is returned when an ereb server answers with a status other
+// than 200. Body holds the start of the response.
+type StatusError struct {
+	URL  string
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Unable to get valid stat result from '%s', http response code : %d, response: %s", e.URL, e.Code, e.Body)
+}
+
+// AuthError is returned when an ereb server rejects the request with 401 or
+// 403. It unwraps to the underlying *StatusError.
+type AuthError struct {
+	StatusError
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("Authentication failed for '%s', http response code : %d, check that credentials are configured and correct", e.URL, e.Code)
+}
+
+func (e *AuthError) Unwrap() error {
+	return &e.StatusError
+}
+
+// DecodeError is returned when an ereb response is not the expected JSON.
+type DecodeError struct {
+	URL string
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("Unable to decode response from '%s': %s", e.URL, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// unixHostSuffix marks the hosts standing for a Unix socket, see endpoint.
+const unixHostSuffix = ".unix-socket"
+
+// dialContext connects to the Unix socket named by the host of addr, as
+// built by endpoint, and over TCP otherwise.
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if host, _, err := net.SplitHostPort(addr); err == nil && strings.HasSuffix(host, unixHostSuffix) {
+		socket, err := hex.DecodeString(strings.TrimSuffix(host, unixHostSuffix))
+		if err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(ctx, "unix", string(socket))
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// maxErrorBodySize bounds how much of a non-200 response ends up in an error.
+const maxErrorBodySize = 4096
+
+type gatherFunc func(g *Ereb, s *server, acc telegraf.Accumulator) error
+// gatherFunctions returns the collectors available to run against every server,
+// by name. The map only holds functions, the state they use lives on Ereb.
+func gatherFunctions() map[string]gatherFunc {
+	return map[string]gatherFunc{
+		"status":      gatherStatus,
+		"tasks":       gatherTasks,
+		"recent_runs": gatherRecentRuns,
+		"groups":      gatherGroups,
+	}
+}
+
+// defaultServer is gathered from when no servers are configured.
+const defaultServer = "http://localhost:8888"
 
 const sampleConfig = `
   ## An array of address to gather stats about.
-  ## If no servers are specified, then default to 127.0.0.1:8888
-  # servers = ["http://localhost:8888"]
+  ## If no servers are specified, then default to default_server
+  # servers = ["` + defaultServer + `"]
+  ## An ereb listening on a Unix socket is given as "unix:///var/run/ereb.sock",
+  ## its hostname tag is the socket path. Metrics are tagged with the
+  ## hostname and, unless it is the default of the scheme, the port of each
+  ## server.
+
+  ## Server gathered from when none are configured.
+  # default_server = "` + defaultServer + `"
+
+  ## Fail instead of falling back to default_server when no servers are
+  ## configured, including a servers_file without any.
+  # require_servers = false
+
+  ## File with additional server addresses, one per line. Blank lines and
+  ## lines starting with # are ignored. It is re-read on every gather.
+  # servers_file = "/etc/telegraf/ereb_servers"
+
+  ## Telegraf's startup_error_behavior = "probe" requests /status from every
+  ## server at startup and skips the input unless all of them answer. Init
+  ## does not contact the servers, so the error, retry and ignore modes only
+  ## act on configuration errors, never on an unreachable server.
+  # startup_error_behavior = "probe"
+
+  ## API base paths to try, in order, for servers running different ereb
+  ## versions. The next one is tried when a server answers 404 and the
+  ## one that worked is remembered per server.
+  # base_paths = ["/api/v2", ""]
+
+  ## Endpoint paths, for forks of ereb serving them elsewhere.
+  # status_path = "/status"
+  # tasks_path = "/tasks"
+  # recent_runs_path = "/task_runs/recent"
+
+  ## Extra numeric keys of /status passed through as ereb_status fields,
+  ## for values this plugin does not know about yet.
+  # status_fields = ["workers"]
+
+  ## Method and JSON body of the requests, for gateways only answering to
+  ## something else than a plain GET.
+  # request_method = "GET"
+  # request_body = ""
+
+  ## HTTP request timeout.
+  # timeout = "30s"
+
+  ## Responses larger than this are rejected rather than decoded; 0 lifts
+  ## the limit.
+  # max_body_size = "4MB"
+
+  ## Retry a request this many times when the connection fails or the
+  ## server answers with one of retryable_status_codes, waiting a little
+  ## longer before each attempt. Other errors are never retried. All
+  ## attempts share the timeout. Only GET and HEAD requests are retried
+  ## unless retry_non_idempotent is set, for gateways answering reads to
+  ## another request_method.
+  # retries = 0
+  # retryable_status_codes = [502, 503, 504]
+  # retry_non_idempotent = false
+
+  ## Connection reuse. Raise max_idle_conns when gathering from many
+  ## servers at short intervals; 0 means no limit.
+  # max_idle_conns = 100
+  # idle_conn_timeout = "90s"
+
+  ## HTTP/2 is used when a server offers it over TLS, set this for servers
+  ## or gateways misbehaving with it.
+  # force_http1 = false
+
+  ## Follow redirects, tagging the metrics with the hostname and port
+  ## redirected to.
+  ## When disabled, a redirect is reported as an error.
+  # follow_redirects = true
+
+  ## Answer Digest authentication challenges with the username and password
+  ## instead of sending them as basic auth.
+  # digest_auth = false
+
+  ## netrc file with the credentials of servers configured without any,
+  ## $HOME/.netrc by default. A missing file or entry means no credentials.
+  ## Its default entry, if any, is sent to every server without credentials
+  ## of its own and without a machine entry.
+  # netrc_file = "/etc/telegraf/ereb.netrc"
+
+  ## Task durations are emitted in milliseconds as avg_duration_ms,
+  ## max_duration_ms and min_duration_ms. The raw ereb values (seconds) are
+  ## also emitted as avg_duration, max_duration and min_duration unless
+  ## legacy fields are disabled.
+  # legacy_duration_fields = true
+
+  ## Also emit the durations reported as one duration_summary string such
+  ## as "min=1000,avg=1500,max=2000", in milliseconds.
+  # duration_summary_field = false
+
+  ## Stamp status and task metrics with the generated_at time reported in
+  ## /status instead of the local time, avoiding skew between collectors.
+  ## Servers not reporting it keep the local time.
+  # use_server_time = false
+
+  ## Emit ereb_tasks for disabled tasks as well.
+  # include_disabled_tasks = true
+
+  ## Only emit ereb_tasks for tasks with at least one recorded run, enabled
+  ## or not.
+  # require_stats = false
+
+  ## Mark tasks with more errors than this as unhealthy; -1 disables it.
+  # error_threshold = -1
+
+  ## Emit duration_ema, a moving average of max_duration across gathers
+  ## reacting faster than the lifetime average. Each gather weighs the new
+  ## value by this factor, between 0 and 1; 0 disables it.
+  # duration_ema_factor = 0.0
+
+  ## Emit the last N exit codes of each task as exit_code_0 (the most
+  ## recent), exit_code_1 and so on; 0 disables them.
+  # recent_exit_code_fields = 0
+
+  ## Maximum number of runs taken from the recent runs feed on each gather.
+  # max_recent_runs = 50
+
+  ## Collectors to run against each server. Available: "status", "tasks",
+  ## "recent_runs", "groups". All but "recent_runs" run by default, as the
+  ## recent runs feed costs another request per gather.
+  # collectors = ["status", "tasks", "groups"]
+
+  ## Only check that each server responds, emitting ereb_status with a single
+  ## ereb_up field. Useful for a separate high-frequency liveness instance.
+  # health_check_only = false
+
+  ## Emit metrics about the plugin itself: ereb_gather with the wall-clock
+  ## duration of each gather and ereb_request with the response size of
+  ## each request.
+  # gather_internal_metrics = false
+
+  ## Add the time spent in DNS, connect, TLS handshake and until the first
+  ## response byte to ereb_request, as dns_ms, connect_ms, tls_ms and
+  ## ttfb_ms. Off by default to spare the overhead.
+  # trace = false
+
+  ## Emit a single ereb_fleet point per gather with the number of reachable
+  ## servers and the tasks and failing tasks across all of them.
+  # fleet_summary = false
+
+  ## Fetch the log of the last run of each failing task from
+  ## /tasks/<id>/last_run/log and emit its tail as ereb_task_failures,
+  ## keeping at most failure_log_size bytes of it.
+  # failure_logs = false
+  # failure_log_size = "4KB"
+
+  ## Delay the requests to each server by a random amount up to this value to
+  ## spread the load. The delay counts against the timeout, so a gather still
+  ## completes within it; the jitter must be shorter and is best kept well
+  ## below it.
+  # scrape_jitter = "0s"
+
+  ## Queued tasks count as imminent in next_run_imminent when the next run
+  ## is due within this window.
+  # imminent_window = "1m"
+
+  ## Set next_run_stalled once next_run stayed the same over this many
+  ## gathers in a row, a sign of a wedged scheduler; 0 disables it.
+  # stall_threshold = 0
+
+  ## Also emit the running field of ereb_status as value, for pipelines
+  ## expecting a single value field per measurement.
+  # legacy_value_field = false
+
+  ## Tag ereb_status and ereb_running_tasks with the version reported in
+  ## /status, and ereb_tasks as well with version_tag_tasks. Off by default
+  ## as every rollout starts new series.
+  # version_tag = false
+  # version_tag_tasks = false
+
+  ## Tag ereb_tasks with the state of the scheduler reported in /status,
+  ## such as "running" or "paused". Off by default as every pause and
+  ## resume starts new series.
+  # scheduler_state_tag = false
+
+  ## Rename emitted field keys, keys without an entry are kept as they are.
+  # [inputs.ereb.field_rename]
+  #   errors_count = "failures"
+
+  ## Basic auth credentials by the realm of the WWW-Authenticate challenge,
+  ## for gateways protecting endpoints with different realms. A request
+  ## answered with 401 is retried once with the credentials of its realm.
+  # [inputs.ereb.realm_credentials.status]
+  #   username = "telegraf"
+  #   password = "@{secretstore:ereb_status_password}"
+
+  ## Servers needing their own credentials can be given as tables, alongside
+  ## or instead of the servers list. Credentials embedded in a server URL
+  ## are used when no username is set. Passwords and tokens may reference
+  ## a secret store, and a bearer token takes precedence over basic auth.
+  # [[inputs.ereb.server]]
+  #   url = "http://ereb-1:8888"
+  #   username = "telegraf"
+  #   password = "@{secretstore:ereb_password}"
+  #   # bearer_token = "@{secretstore:ereb_token}"
+  #   ## Overrides the timeout above for this server only.
+  #   # timeout = "5s"
 `
 
-func (g *ereb) debug(logString interface{}) {
+// parseTimeout returns a task timeout in seconds. ereb sends plain seconds,
+// Go duration strings such as "1h" are accepted as well.
+func parseTimeout(timeout string) (float64, bool) {
+	if seconds, err := strconv.ParseFloat(timeout, 64); err == nil {
+		return seconds, true
+	}
+	if d, err := time.ParseDuration(timeout); err == nil {
+		return d.Seconds(), true
+	}
+	return 0, false
+}
+
+// durationMs converts a duration reported by ereb (in seconds) to milliseconds.
+func durationMs(seconds float64) float64 {
+	return seconds * 1000
+}
+
+func (g *Ereb) debug(logString interface{}) {
 	if g.debug_mode {
 		log.Printf("%v\n", logString)
 	}
 }
 
 
-func (g *ereb) SampleConfig() string {
+// New returns an Ereb input with default settings gathering from servers.
+func New(servers ...string) *Ereb {
+	return &Ereb{
+		Servers:              servers,
+		FollowRedirects:      true,
+		RequestMethod:        "GET",
+		StatusPath:           "/status",
+		TasksPath:            "/tasks",
+		RecentRunsPath:       "/task_runs/recent",
+		Timeout:              config.Duration(30 * time.Second),
+		MaxIdleConns:         100,
+		IdleConnTimeout:      config.Duration(90 * time.Second),
+		MaxBodySize:          config.Size(4 * 1024 * 1024),
+		FailureLogSize:       config.Size(4 * 1024),
+		RetryableStatusCodes: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		LegacyDurationFields: true,
+		MaxRecentRuns:        50,
+		ImminentWindow:       config.Duration(time.Minute),
+		IncludeDisabledTasks: true,
+		ErrorThreshold:       -1,
+	}
+}
+
+func (g *Ereb) SampleConfig() string {
 	return sampleConfig
 }
 
-func (g *ereb) Description() string {
+func (g *Ereb) Description() string {
 	return "Read task details from your ereb instance"
 }
 
 
-func (g *ereb) Gather(acc telegraf.Accumulator) error {
-	if len(g.Servers) == 0 {
-		g.Servers = append(g.Servers, "http://localhost:8888")
+// Init validates the configuration before the first gather.
+func (g *Ereb) Init() error {
+	available := gatherFunctions()
+	for _, name := range g.Collectors {
+		if _, ok := available[name]; !ok {
+			return fmt.Errorf("Unknown collector '%s'", name)
+		}
 	}
 
-	endpoints := make([]string, 0, len(g.Servers))
+	if g.DurationEmaFactor < 0 || g.DurationEmaFactor > 1 {
+		return fmt.Errorf("Invalid duration_ema_factor %v, must be between 0 and 1", g.DurationEmaFactor)
+	}
 
-	trailingSlash := "/"
-	for _, endpoint := range g.Servers {
-		if strings.HasPrefix(endpoint, "http") {
-			if strings.HasSuffix(endpoint, trailingSlash) {
-				endpoint = strings.TrimRight(endpoint, trailingSlash)
-			}
-			endpoints = append(endpoints, endpoint)
-			continue
+	// The jitter counts against the timeout of each server, a longer one
+	// would leave no time for the requests
+	timeouts := []config.Duration{g.Timeout}
+	for _, sc := range g.ServerConfigs {
+		timeouts = append(timeouts, sc.Timeout)
+	}
+	for _, timeout := range timeouts {
+		if g.ScrapeJitter > 0 && timeout > 0 && g.ScrapeJitter >= timeout {
+			return fmt.Errorf("Invalid scrape_jitter %s, must be shorter than the timeout of %s", time.Duration(g.ScrapeJitter), time.Duration(timeout))
+		}
+	}
+
+	addresses := append([]string{}, g.Servers...)
+	for _, sc := range g.ServerConfigs {
+		addresses = append(addresses, sc.URL)
+	}
+
+	if g.ServersFile != "" {
+		fileServers, err := g.readServersFile()
+		if err != nil {
+			return err
+		}
+		addresses = append(addresses, fileServers...)
+	}
+
+	if len(addresses) == 0 && g.RequireServers {
+		return errNoServers
+	}
+
+	if err := g.loadNetrc(); err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+		// Telegraf expands environment variables when loading the config,
+		// anything left over points at a variable that was not set
+		if strings.Contains(address, "$") {
+			return fmt.Errorf("Server address '%s' contains an unexpanded environment variable", redactURL(address))
+		}
+		if strings.HasPrefix(address, "unix://") && g.Client != nil {
+			return socketClientError(address)
+		}
+	}
+
+	return nil
+}
+
+func (g *Ereb) Gather(acc telegraf.Accumulator) error {
+	start := time.Now()
+
+	servers, errs := g.buildServers()
+	for _, err := range errs {
+		if errors.Is(err, errNoServers) {
+			return err
 		}
+		acc.AddError(err)
 	}
 
+	fleet := &fleetTotals{}
+	endpoints := make([]string, 0, len(servers))
+	for _, srv := range servers {
+		srv.acc = acc
+		srv.fleet = fleet
+		srv.tasksReported = g.collects("tasks") && !g.HealthCheckOnly
+		endpoints = append(endpoints, srv.url.Redacted())
+	}
 
+	functions := g.selectedFunctions()
+	if g.HealthCheckOnly {
+		functions = []gatherFunc{gatherHealth}
+	} else {
+		if g.FleetSummary {
+			functions = append(functions, gatherFleet)
+		}
+		if g.FailureLogs {
+			functions = append(functions, gatherFailureLogs)
+		}
+	}
 
 	var wg sync.WaitGroup
-	wg.Add(len(endpoints) * len(gatherFunctions))
+	wg.Add(len(servers) * len(functions))
 	g.debug("Iterating endpoints")
 	g.debug(endpoints)
-	for _, server := range endpoints {
-		for _, f := range gatherFunctions {
-			go func(serv string, gf gatherFunc) {
+	for _, srv := range servers {
+		srv.ctx = context.Background()
+		if timeout := g.serverTimeout(srv); timeout > 0 {
+			var cancel context.CancelFunc
+			srv.ctx, cancel = context.WithTimeout(srv.ctx, timeout)
+			defer cancel()
+		}
+
+		delay := g.jitter()
+		for _, f := range functions {
+			go func(serv *server, gf gatherFunc) {
 				defer wg.Done()
+				select {
+				case <-time.After(delay):
+				case <-serv.ctx.Done():
+				}
 				if err := gf(g, serv, acc); err != nil {
 					g.debug(err.Error())
 					acc.AddError(err)
 				}
-			}(server, f)
+			}(srv, f)
 		}
 	}
 
 	wg.Wait()
+
+	if g.FleetSummary && !g.HealthCheckOnly {
+		fields := map[string]interface{}{
+			"servers":           len(servers),
+			"reachable_servers": fleet.reachableServers,
+			"tasks":             fleet.tasks,
+			"failing_tasks":     fleet.failingTasks,
+		}
+		acc.AddFields("ereb_fleet", g.renameFields(fields), map[string]string{}, start)
+	}
+
+	if g.GatherInternalMetrics {
+		fields := map[string]interface{}{
+			"duration_ms": durationMs(time.Since(start).Seconds()),
+		}
+		acc.AddFields("ereb_gather", fields, map[string]string{}, start)
+	}
+
 	return nil
 }
 
-func gatherStatus(g *ereb, serverAddr string, acc telegraf.Accumulator) error {
-	erebStatus := &ErebStatus{}
-	g.debug("Gathering status for " + serverAddr)
-	err := g.getJson(serverAddr + "/status", &erebStatus)
-	if err != nil {
-		return err
+// errNoServers is returned when require_servers is set and no server is
+// configured.
+var errNoServers = errors.New("No servers configured and require_servers is set")
+
+// buildServers resolves the configured addresses into the servers to gather
+// from. An invalid entry is reported without dropping the other servers.
+func (g *Ereb) buildServers() ([]*server, []error) {
+	var errs []error
+
+	addresses := g.Servers
+	if g.ServersFile != "" {
+		// Keep gathering from the inline servers if the file is unreadable
+		fileServers, err := g.readServersFile()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		addresses = append(append([]string{}, g.Servers...), fileServers...)
 	}
 
-	u, err := url.Parse(serverAddr)
+	// Tables come first, so that a server also listed in servers keeps the
+	// credentials and timeout of its table when the duplicate is dropped
+	configs := make([]ServerConfig, 0, len(addresses)+len(g.ServerConfigs))
+	configs = append(configs, g.ServerConfigs...)
+	for _, endpoint := range addresses {
+		configs = append(configs, ServerConfig{URL: endpoint})
+	}
 
-	tags := map[string]string{"hostname": u.Host}
+	if len(configs) == 0 && g.RequireServers {
+		return nil, append(errs, errNoServers)
+	}
 
-	now := time.Now()
-	is_running := 0
-	if erebStatus.State == "running" {
-		is_running = 1
+	// The default server is added for this gather only, leaving g.Servers as
+	// configured
+	if len(configs) == 0 && g.ServersFile == "" {
+		address := g.DefaultServer
+		if address == "" {
+			address = defaultServer
+		}
+		configs = append(configs, ServerConfig{URL: address})
 	}
 
-	fields := map[string]interface{}{
-		"running": is_running,
-		"tasks_queue_length": len(erebStatus.NextTasks),
-		"next_run_in": erebStatus.NextRun,
+	servers := make([]*server, 0, len(configs))
+	seen := make(map[string]bool, len(configs))
+	var duplicates []string
+	for _, sc := range configs {
+		if !strings.HasPrefix(sc.URL, "http") && !strings.HasPrefix(sc.URL, "unix://") {
+			continue
+		}
+
+		s, err := newServer(sc)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if s.socket != "" && g.Client != nil {
+			errs = append(errs, socketClientError(sc.URL))
+			continue
+		}
+		g.applyNetrc(s)
+
+		// The same server listed twice would emit colliding points
+		if seen[s.url.String()] {
+			duplicates = append(duplicates, s.url.Redacted())
+			continue
+		}
+		seen[s.url.String()] = true
+
+		servers = append(servers, s)
 	}
 
-	acc.AddFields("ereb_status", fields, tags, now)
+	if len(duplicates) > 0 {
+		g.debug("Ignoring duplicate servers: " + strings.Join(duplicates, ", "))
+	}
 
-	return err
+	return servers, errs
 }
 
+// newServer parses a server config, taking credentials from the URL when
+// none are given separately.
+func newServer(sc ServerConfig) (*server, error) {
+	endpoint := sc.URL
 
-func gatherTasks(g *ereb, serverAddr string, acc telegraf.Accumulator) error {
-	g.debug("Gathering tasks for " + serverAddr)
-	now := time.Now()
-	erebTasks := ErebTasks{}
-	err := g.getJson(serverAddr + "/tasks", &erebTasks)
+	u, err := url.Parse(endpoint)
 	if err != nil {
-		return err
+		// The parse error repeats the address, credentials included
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("Unable parse server address '%s': %s", redactURL(endpoint), err)
 	}
 
-	u, err := url.Parse(serverAddr)
+	// Drop a single trailing slash of the path, keeping the query as it is
+	trailingSlash := "/"
+	u.Path = strings.TrimSuffix(u.Path, trailingSlash)
+	u.RawPath = strings.TrimSuffix(u.RawPath, trailingSlash)
 
-	g.debug(len(erebTasks))
-	for _, task := range erebTasks {
-		g.debug(task)
-		tags := map[string]string{
-			"hostname": u.Host,
-			"task_tag": task.Name,
-		}
+	password, err := secretString(&sc.Password)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get password of server '%s': %s", redactURL(endpoint), err)
+	}
+	token, err := secretString(&sc.BearerToken)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get bearer token of server '%s': %s", redactURL(endpoint), err)
+	}
 
-		exitCodes := task.Stats.ExitCodes
-		var lastExitCode string
+	s := &server{url: u, username: sc.Username, password: password, token: token, timeout: time.Duration(sc.Timeout)}
+	if s.username == "" && u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if u.Scheme == "unix" {
+		s.socket = u.Path
+	}
+	return s, nil
+}
 
-		lastErrorsCount := 0
+// redactURL hides the password of an address for errors and logs, also when
+// the address cannot be parsed.
+func redactURL(address string) string {
+	if u, err := url.Parse(address); err == nil {
+		return u.Redacted()
+	}
+	scheme := strings.Index(address, "://")
+	at := strings.LastIndex(address, "@")
+	if scheme < 0 || at < scheme {
+		return address
+	}
+	return address[:scheme+3] + "xxxxx" + address[at:]
+}
 
-		// If we don't have stats for this task,
-		// maybe it has been disabled
-		if len(exitCodes) == 0 {
-			lastExitCode = "-1"
-		} else {
-			lastExitCode = exitCodes[len(exitCodes)-1]
-
-			// Count non-zero exit codes
-			for _, exitCode := range exitCodes {
-				if exitCode != "None" {
-					intExitCode, _ := strconv.Atoi(exitCode)
-					g.debug(task.Name + ", " + exitCode + ", " + strconv.Itoa(intExitCode))
-					if intExitCode > 0 {
-						lastErrorsCount++
-					} else if intExitCode == 0 {
-						lastErrorsCount = 0
-					}
-				}
+// tags returns the tags identifying the server: hostname and, unless it is
+// the default of the scheme, port, so servers sharing a host stay apart.
+func (s *server) tags() map[string]string {
+	tags := map[string]string{"hostname": s.hostname()}
+	if port := s.port(); port != "" {
+		tags["port"] = port
+	}
+	return tags
+}
 
-			}
-		}
+// hostname returns the value of the hostname tag of the server, the socket
+// path for a Unix socket.
+func (s *server) hostname() string {
+	if s.socket != "" {
+		return s.socket
+	}
+	return s.answering().Hostname()
+}
 
+// port returns the value of the port tag of the server, "" for a Unix socket
+// or the default port of the scheme.
+func (s *server) port() string {
+	if s.socket != "" {
+		return ""
+	}
+	u := s.answering()
+	if port := u.Port(); port != defaultPorts[u.Scheme] {
+		return port
+	}
+	return ""
+}
 
+// defaultPorts are the ports left out of the port tag, by scheme.
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
 
-		taskTimeout, _ := strconv.Atoi(task.Timeout)
+// answering returns the URL of the server answering the requests of s, the
+// one they were last redirected to if any.
+func (s *server) answering() *url.URL {
+	s.redirectMu.Lock()
+	defer s.redirectMu.Unlock()
+	if s.redirected != nil {
+		return s.redirected
+	}
+	return s.url
+}
 
-		fields := map[string]interface{}{
-			"task_name":      task.Name,
-			"enabled":        task.Enabled,
-			"success_count":  task.Stats.Success,
-			"errors_count":   task.Stats.Error,
-			"avg_duration":   task.Stats.DurationAvg,
-			"max_duration":   task.Stats.DurationMax,
-			"min_duration":   task.Stats.DurationMin,
-			"timeout":        taskTimeout,
-			"last_exit_code": lastExitCode,
-			"last_errors_count": lastErrorsCount,
+// followedRedirect records where a request of s was redirected to, so the
+// hostname and port tags name the server that actually answered.
+func (s *server) followedRedirect(res *http.Response, endpoint *url.URL) {
+	if s.socket != "" || res.Request == nil || res.Request.URL.Host == endpoint.Host {
+		return
+	}
+	s.redirectMu.Lock()
+	s.redirected = res.Request.URL
+	s.redirectMu.Unlock()
+}
+
+// endpoint returns the URL of path on the server. Credentials are sent by
+// doRequest, so the userinfo is left out.
+func (s *server) endpoint(path string) *url.URL {
+	if s.socket != "" {
+		// The socket path is carried in the host for the transport to dial,
+		// each socket getting its own connections
+		return &url.URL{
+			Scheme:   "http",
+			Host:     hex.EncodeToString([]byte(s.socket)) + unixHostSuffix,
+			Path:     path,
+			RawQuery: s.url.RawQuery,
 		}
+	}
 
-		acc.AddFields("ereb_tasks", fields, tags, now)
+	u := *s.url
+	u.User = nil
+	u.Path = s.url.Path + path
+	u.RawPath = ""
+	if s.url.RawPath != "" {
+		// Keep escapes such as %2F of the server path as they are
+		u.RawPath = s.url.RawPath + path
 	}
+	return &u
+}
 
-	return err
+// Probe checks that every server can be reached and answers /status with
+// valid JSON, without emitting metrics. The returned error lists each failing
+// server; Telegraf uses it to probe inputs before starting them when the
+// input is configured with startup_error_behavior = "probe".
+func (g *Ereb) Probe() error {
+	return g.checkServers()
+}
+
+// checkServers requests /status from every server and reports those that
+// cannot be reached or answer with something else than ereb's status.
+func (g *Ereb) checkServers() error {
+	servers, errs := g.buildServers()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(len(servers))
+	for _, srv := range servers {
+		go func(s *server) {
+			defer wg.Done()
+			if err := g.getJson(s, g.StatusPath, &ErebStatus{}); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
 }
 
+// secretString returns the content of secret, "" when it is not set.
+func secretString(secret *config.Secret) (string, error) {
+	if secret.Empty() {
+		return "", nil
+	}
+	buf, err := secret.Get()
+	if err != nil {
+		return "", err
+	}
+	defer buf.Destroy()
+	return buf.String(), nil
+}
 
+// renameFields applies FieldRename to the keys of fields.
+func (g *Ereb) renameFields(fields map[string]interface{}) map[string]interface{} {
+	if len(g.FieldRename) == 0 {
+		return fields
+	}
 
-func (g *ereb) getJson(requestUrl string, target interface{}) error {
-	if g.client == nil {
-		tr := &http.Transport{ResponseHeaderTimeout: time.Duration(30 * time.Second)}
-		client := &http.Client{
-			Transport: tr,
-			Timeout:   time.Duration(30 * time.Second),
+	renamed := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		if newKey, ok := g.FieldRename[key]; ok {
+			key = newKey
 		}
-		g.client = client
+		renamed[key] = value
 	}
+	return renamed
+}
 
-	u, err := url.Parse(requestUrl)
-	if err != nil {
-		return fmt.Errorf("Unable parse server address '%s': %s", requestUrl, err)
+// defaultCollectors are run when no collectors are configured.
+var defaultCollectors = []string{"status", "tasks", "groups"}
+
+// collects tells whether the named collector is enabled.
+func (g *Ereb) collects(name string) bool {
+	collectors := g.Collectors
+	if len(collectors) == 0 {
+		collectors = defaultCollectors
+	}
+	for _, c := range collectors {
+		if c == name {
+			return true
+		}
 	}
+	return false
+}
 
-	req, err := http.NewRequest("GET", requestUrl, nil)
-	if u.User != nil {
-		p, _ := u.User.Password()
-		req.SetBasicAuth(u.User.Username(), p)
+// selectedFunctions returns the gather functions of the enabled collectors.
+func (g *Ereb) selectedFunctions() []gatherFunc {
+	functions := []gatherFunc{}
+	for name, f := range gatherFunctions() {
+		if g.collects(name) {
+			functions = append(functions, f)
+		}
 	}
+	return functions
+}
 
-	res, err := g.client.Do(req)
+// readServersFile returns the server addresses listed in ServersFile.
+func (g *Ereb) readServersFile() ([]string, error) {
+	content, err := ioutil.ReadFile(g.ServersFile)
 	if err != nil {
-		return fmt.Errorf("Unable to connect to ereb server '%s': %s", requestUrl, err)
+		return nil, fmt.Errorf("Unable to read servers file '%s': %s", g.ServersFile, err)
 	}
 
-	if res.StatusCode != 200 {
-		return fmt.Errorf("Unable to get valid stat result from '%s', http response code : %d", requestUrl, res.StatusCode)
+	var addresses []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addresses = append(addresses, line)
 	}
+	return addresses, nil
+}
 
-	defer res.Body.Close()
-
+// netrcEntry holds the credentials of a machine in a netrc file.
+type netrcEntry struct {
+	login    string
+	password string
+}
 
-	json.NewDecoder(res.Body).Decode(target)
+// loadNetrc reads NetrcFile, or $HOME/.netrc when it is not set. A missing
+// file is not an error, servers are then gathered without its credentials.
+// Neither is an unreadable $HOME/.netrc, as it was not configured.
+func (g *Ereb) loadNetrc() error {
+	path := g.NetrcFile
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		g.debug("No netrc file at " + path)
+		return nil
+	}
+	if err != nil && g.NetrcFile == "" {
+		g.debug("Ignoring netrc file at " + path + ": " + err.Error())
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read netrc file '%s': %s", path, err)
+	}
+	g.netrc = parseNetrc(string(content))
+	return nil
+}
+
+// parseNetrc returns the entries of a netrc file by machine, the default
+// entry under "". The first entry of a machine wins. Macro definitions are
+// only allowed at the end of the file, where parsing stops.
+func parseNetrc(content string) map[string]netrcEntry {
+	entries := make(map[string]netrcEntry)
+
+	var machine string
+	var entry netrcEntry
+	inEntry := false
+	flush := func() {
+		if _, ok := entries[machine]; inEntry && !ok {
+			entries[machine] = entry
+		}
+	}
+
+	tokens := strings.Fields(content)
+	for i := 0; i < len(tokens); i++ {
+		next := func() string {
+			if i+1 < len(tokens) {
+				i++
+				return tokens[i]
+			}
+			return ""
+		}
+		switch tokens[i] {
+		case "machine":
+			flush()
+			machine, entry, inEntry = next(), netrcEntry{}, true
+		case "default":
+			flush()
+			machine, entry, inEntry = "", netrcEntry{}, true
+		case "login":
+			entry.login = next()
+		case "password":
+			entry.password = next()
+		case "account":
+			next()
+		case "macdef":
+			flush()
+			return entries
+		}
+	}
+	flush()
+	return entries
+}
+
+// applyNetrc sets the netrc credentials of the host of s, if it has no
+// credentials of its own.
+func (g *Ereb) applyNetrc(s *server) {
+	if s.username != "" || s.token != "" || g.netrc == nil {
+		return
+	}
+	entry, ok := g.netrc[s.url.Hostname()]
+	if !ok {
+		entry, ok = g.netrc[""]
+	}
+	if ok && entry.login != "" {
+		s.username = entry.login
+		s.password = entry.password
+	}
+}
+
+// jitter returns a random delay bounded by ScrapeJitter.
+func (g *Ereb) jitter() time.Duration {
+	if g.ScrapeJitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(g.ScrapeJitter)))
+}
+
+// gatherHealth reports whether the server answers /status at all,
+// a failed check is a data point rather than a gather error.
+func gatherHealth(g *Ereb, s *server, acc telegraf.Accumulator) error {
+	serverAddr := s.url.Redacted()
+	g.debug("Checking health of " + serverAddr)
+	now := time.Now()
+
+	up := 1
+	if err := g.getJson(s, g.StatusPath, &ErebStatus{}); err != nil {
+		g.debug(err.Error())
+		up = 0
+	}
+
+	tags := s.tags()
+	fields := map[string]interface{}{"ereb_up": up}
+
+	acc.AddFields("ereb_status", g.renameFields(fields), tags, now)
+
+	return nil
+}
+
+func gatherStatus(g *Ereb, s *server, acc telegraf.Accumulator) error {
+	serverAddr := s.url.Redacted()
+	g.debug("Gathering status for " + serverAddr)
+	erebStatus, err := g.fetchStatus(s)
+	if err != nil {
+		return err
+	}
+
+	tags := s.tags()
+	if g.VersionTag && erebStatus.Version != "" {
+		tags["version"] = erebStatus.Version
+	}
+
+	// Ages are measured against the same clock as the metric time
+	now := g.metricTime(erebStatus)
+	is_running := 0
+	if erebStatus.State == "running" {
+		is_running = 1
+	}
+
+	// A deliberately paused scheduler is not running either, but must not
+	// look like a failure
+	is_paused := 0
+	if erebStatus.State == "paused" || (erebStatus.Paused != nil && *erebStatus.Paused) {
+		is_paused = 1
+	}
+
+	// Share of the queued tasks that are enabled, 0 for an empty queue
+	enabledQueued := 0
+	for _, task := range erebStatus.NextTasks {
+		if task.Enabled {
+			enabledQueued++
+		}
+	}
+	enabledQueueRatio := 0.0
+	if len(erebStatus.NextTasks) > 0 {
+		enabledQueueRatio = float64(enabledQueued) / float64(len(erebStatus.NextTasks))
+	}
+
+	// ereb only tells when the next run is, so the whole queue is imminent
+	// once that falls within the window, overdue runs included
+	imminent := 0
+	if erebStatus.NextRun <= time.Duration(g.ImminentWindow).Seconds() {
+		imminent = len(erebStatus.NextTasks)
+	}
+
+	fields := map[string]interface{}{
+		"running": is_running,
+		"paused": is_paused,
+		"tasks_queue_length": len(erebStatus.NextTasks),
+		"enabled_queue_ratio": enabledQueueRatio,
+		// In seconds, as ereb reports it
+		"next_run_in": erebStatus.NextRun,
+		// A next run in the past means the scheduler is behind its schedule
+		"next_run_overdue": erebStatus.NextRun < 0,
+		"next_run_imminent": imminent,
+	}
+
+	if erebStatus.Uptime != nil {
+		fields["uptime_seconds"] = *erebStatus.Uptime
+	} else if erebStatus.StartedAt != nil {
+		fields["uptime_seconds"] = float64(now.UnixNano())/float64(time.Second) - *erebStatus.StartedAt
+	}
+
+	// An old entry means the queue is stalled rather than just short
+	oldestPlanned := 0.0
+	for _, run := range erebStatus.PlannedTaskRuns {
+		if run.PlannedAt > 0 && (oldestPlanned == 0 || run.PlannedAt < oldestPlanned) {
+			oldestPlanned = run.PlannedAt
+		}
+	}
+	if oldestPlanned > 0 {
+		fields["oldest_queued_run_age_seconds"] = float64(now.UnixNano())/float64(time.Second) - oldestPlanned
+	}
+
+	// Task counts come from /tasks, a failure there is reported by gatherTasks.
+	// Skip them when tasks are not collected to spare the request.
+	if g.collects("tasks") {
+		if erebTasks, err := g.fetchTasks(s); err == nil {
+			enabledTasks := 0
+			failingTasks := 0
+			manualTasks := 0
+			for _, task := range erebTasks {
+				if task.Enabled {
+					enabledTasks++
+				}
+				if task.CronSchedule == "" {
+					manualTasks++
+				}
+				if g.summarizeExitCodes(task.Name, task.Stats.ExitCodes).lastErrorsCount > 0 {
+					failingTasks++
+				}
+			}
+			// Tells a server without tasks apart from a failed scrape
+			fields["tasks_seen"] = len(erebTasks)
+			if s.tasksCount != nil {
+				fields["tasks_count"] = *s.tasksCount
+			}
+			fields["enabled_tasks"] = enabledTasks
+			fields["failing_tasks"] = failingTasks
+			fields["manual_tasks"] = manualTasks
+
+			added, removed := g.taskChanges(s, erebTasks)
+			fields["tasks_added"] = added
+			fields["tasks_removed"] = removed
+		}
+	}
+
+	if g.StallThreshold > 0 {
+		fields["next_run_stalled"] = g.nextRunStalled(s, erebStatus.NextRun)
+	}
+
+	if g.LegacyValueField {
+		fields["value"] = is_running
+	}
+
+	for _, key := range g.StatusFields {
+		if _, ok := fields[key]; ok {
+			continue
+		}
+		if value, ok := s.statusFields[key].(float64); ok {
+			fields[key] = value
+		} else if _, ok := s.statusFields[key]; ok {
+			g.debug("Status field " + key + " is not numeric, skipping it")
+		}
+	}
+
+	acc.AddFields("ereb_status", g.renameFields(fields), tags, now)
+
+	for _, run := range erebStatus.RunningTaskRuns {
+		runTags := s.tags()
+		runTags["task_tag"] = run.Name
+		runTags["run_uuid"] = run.TaskRunUUID
+		if g.VersionTag && erebStatus.Version != "" {
+			runTags["version"] = erebStatus.Version
+		}
+		runFields := map[string]interface{}{"running": 1}
+		if run.StartedAt > 0 {
+			runFields["running_seconds"] = float64(now.UnixNano())/float64(time.Second) - run.StartedAt
+		}
+		acc.AddFields("ereb_running_tasks", g.renameFields(runFields), runTags, now)
+	}
+
+	return nil
+}
+
+// fleetTotals sums up the servers of a gather for ereb_fleet. The gather
+// functions of all servers run concurrently, hence the mutex.
+type fleetTotals struct {
+	mu               sync.Mutex
+	reachableServers int
+	tasks            int
+	failingTasks     int
+}
+
+// gatherFleet adds the server to the fleet totals. The responses are shared
+// with the other gather functions, which also report their errors.
+func gatherFleet(g *Ereb, s *server, acc telegraf.Accumulator) error {
+	if _, err := g.fetchStatus(s); err != nil {
+		g.debug("Not counting " + s.url.Redacted() + " as reachable: " + err.Error())
+		return nil
+	}
+
+	tasks := 0
+	failingTasks := 0
+	if erebTasks, err := g.fetchTasks(s); err == nil {
+		tasks = len(erebTasks)
+		for _, task := range erebTasks {
+			if g.summarizeExitCodes(task.Name, task.Stats.ExitCodes).lastErrorsCount > 0 {
+				failingTasks++
+			}
+		}
+	}
+
+	s.fleet.mu.Lock()
+	defer s.fleet.mu.Unlock()
+	s.fleet.reachableServers++
+	s.fleet.tasks += tasks
+	s.fleet.failingTasks += failingTasks
+	return nil
+}
+
+// nextRunHistory is the last next_run seen for a server.
+type nextRunHistory struct {
+	nextRun   float64
+	unchanged int
+}
+
+// nextRunStalled records the next_run of the server and tells whether it did
+// not change over StallThreshold gathers.
+func (g *Ereb) nextRunStalled(s *server, nextRun float64) bool {
+	g.nextRunsMu.Lock()
+	defer g.nextRunsMu.Unlock()
+	if g.nextRuns == nil {
+		g.nextRuns = make(map[string]nextRunHistory)
+	}
+
+	history, seen := g.nextRuns[s.url.String()]
+	if seen && history.nextRun == nextRun {
+		history.unchanged++
+	} else {
+		history = nextRunHistory{nextRun: nextRun}
+	}
+	g.nextRuns[s.url.String()] = history
+	return history.unchanged >= g.StallThreshold
+}
+
+// taskChanges returns how many tasks of the server appeared and disappeared
+// since its previous gather, both 0 on the first one.
+func (g *Ereb) taskChanges(s *server, erebTasks ErebTasks) (int, int) {
+	current := make(map[string]bool, len(erebTasks))
+	for _, task := range erebTasks {
+		current[task.TaskID] = true
+	}
+
+	g.taskIDsMu.Lock()
+	defer g.taskIDsMu.Unlock()
+	if g.taskIDs == nil {
+		g.taskIDs = make(map[string]map[string]bool)
+	}
+	previous, seen := g.taskIDs[s.url.String()]
+	g.taskIDs[s.url.String()] = current
+	if !seen {
+		return 0, 0
+	}
+
+	added := 0
+	for id := range current {
+		if !previous[id] {
+			added++
+		}
+	}
+	removed := 0
+	for id := range previous {
+		if !current[id] {
+			removed++
+		}
+	}
+	return added, removed
+}
+
+func gatherTasks(g *Ereb, s *server, acc telegraf.Accumulator) error {
+	serverAddr := s.url.Redacted()
+	g.debug("Gathering tasks for " + serverAddr)
+	now := time.Now()
+	erebTasks, err := g.fetchTasks(s)
+	if err != nil {
+		return err
+	}
+
+	g.debug(len(erebTasks))
+
+	// Only fetch /status when something of it is needed. Without it the
+	// points are still emitted, just without the state and stamped with the
+	// local time in any case.
+	schedulerState := ""
+	version := ""
+	if g.SchedulerStateTag || g.VersionTagTasks || g.UseServerTime {
+		if erebStatus, err := g.fetchStatus(s); err == nil {
+			schedulerState = erebStatus.State
+			version = erebStatus.Version
+			now = g.metricTime(erebStatus)
+		}
+	}
+
+	names := taskNameCounts(erebTasks)
+
+	// Averages of the previous gather, tasks gone since are forgotten
+	var previousEma, currentEma map[string]float64
+	if g.DurationEmaFactor > 0 {
+		g.durationEmaMu.Lock()
+		previousEma = g.durationEma[s.url.String()]
+		g.durationEmaMu.Unlock()
+		currentEma = make(map[string]float64, len(erebTasks))
+	}
+
+	// The enabled task that missed its cron schedule for the longest time
+	longestIdle := 0.0
+	longestIdleTag := ""
+	longestIdleName := ""
+
+	for _, task := range erebTasks {
+		if !task.Enabled && !g.IncludeDisabledTasks {
+			continue
+		}
+		if g.RequireStats && len(task.Stats.ExitCodes) == 0 {
+			continue
+		}
+		g.debug(task)
+
+		taskTag := taskTagFor(task.Name, task.TaskID, names)
+		if taskTag != task.Name {
+			g.debug("Duplicate task name " + task.Name + ", tagging as " + taskTag)
+		}
+
+		tags := s.tags()
+		tags["task_tag"] = taskTag
+		if g.SchedulerStateTag && schedulerState != "" {
+			tags["scheduler_state"] = schedulerState
+		}
+		if g.VersionTagTasks && version != "" {
+			tags["version"] = version
+		}
+
+		codes := g.summarizeExitCodes(task.Name, task.Stats.ExitCodes)
+
+		// Errors per success; 0 when the task never succeeded, including
+		// tasks that only ever failed, as there is nothing to compare against
+		errorRatio := 0.0
+		if task.Stats.Success > 0 {
+			errorRatio = float64(task.Stats.Error) / float64(task.Stats.Success)
+		}
+
+		var enabledScripts []string
+		for _, script := range task.ShellScripts {
+			if script.Enabled {
+				enabledScripts = append(enabledScripts, script.Name)
+			}
+		}
+
+		taskTimeout, hasTimeout := parseTimeout(task.Timeout)
+
+		// A run lasting as long as the timeout was most likely killed
+		timeoutExceeded := hasTimeout && taskTimeout > 0 &&
+			task.Stats.DurationMax != nil && float64(*task.Stats.DurationMax) >= taskTimeout
+
+		fields := map[string]interface{}{
+			"task_name":      task.Name,
+			"enabled":        task.Enabled,
+			"success_count":  task.Stats.Success,
+			"errors_count":   task.Stats.Error,
+			"timeout":        int(taskTimeout),
+			"last_exit_code": codes.lastExitCode,
+			"last_errors_count": codes.lastErrorsCount,
+			"has_run":        codes.hasRun,
+			"exit_code_error_rate": codes.errorRate,
+			"timeout_exceeded": timeoutExceeded,
+			"error_ratio":    errorRatio,
+			"distinct_exit_codes": codes.distinctExitCodes,
+			"unhealthy":      g.ErrorThreshold >= 0 && task.Stats.Error > g.ErrorThreshold,
+			// Separates tasks that never ran from disabled ones with history
+			"has_stats":      len(task.Stats.ExitCodes) > 0 || task.Stats.Success+task.Stats.Error > 0,
+			// How much history ereb keeps, for weighting exit_code_error_rate
+			"exit_code_history_len": len(task.Stats.ExitCodes),
+			// Tasks without a schedule only run on demand
+			"scheduled":      task.CronSchedule != "",
+			"enabled_scripts_count": len(enabledScripts),
+			"enabled_scripts": strings.Join(enabledScripts, ","),
+			// Failing runs are recovered by retries rather than broken
+			"retrying":       task.TryMoreOnError && task.Stats.Error > 0 && codes.lastExitCode == "0",
+		}
+
+		// -1 for tasks that never ran, keeping threshold alerts simple
+		fields["seconds_since_last_run"] = -1.0
+		if task.Stats.LastRun != nil {
+			fields["last_run"] = int64(*task.Stats.LastRun)
+			fields["seconds_since_last_run"] = float64(now.UnixNano())/float64(time.Second) - *task.Stats.LastRun
+		}
+
+		if task.Enabled && task.CronSchedule != "" {
+			if sched, err := cron.ParseStandard(task.CronSchedule); err == nil {
+				fields["next_fire_at"] = sched.Next(now).Unix()
+			} else {
+				g.debug("Invalid cron schedule '" + task.CronSchedule + "' of task " + task.Name + ": " + err.Error())
+			}
+		}
+
+		exitCodes := task.Stats.ExitCodes
+		for i := 0; i < g.RecentExitCodeFields && i < len(exitCodes); i++ {
+			fields["exit_code_" + strconv.Itoa(i)] = exitCodes[len(exitCodes)-1-i]
+		}
+
+		// Durations ereb sent as null are left out rather than
+		// reported as a zero duration
+		if task.Stats.DurationAvg != nil {
+			fields["avg_duration_ms"] = durationMs(*task.Stats.DurationAvg)
+			if g.LegacyDurationFields {
+				fields["avg_duration"] = *task.Stats.DurationAvg
+			}
+		}
+		if task.Stats.DurationMax != nil {
+			fields["max_duration_ms"] = durationMs(float64(*task.Stats.DurationMax))
+			if g.LegacyDurationFields {
+				fields["max_duration"] = *task.Stats.DurationMax
+			}
+		}
+		if task.Stats.DurationMin != nil {
+			fields["min_duration_ms"] = durationMs(float64(*task.Stats.DurationMin))
+			if g.LegacyDurationFields {
+				fields["min_duration"] = *task.Stats.DurationMin
+			}
+		}
+		if currentEma != nil && task.Stats.DurationMax != nil {
+			ema := float64(*task.Stats.DurationMax)
+			if previous, ok := previousEma[task.TaskID]; ok {
+				ema = g.DurationEmaFactor*ema + (1-g.DurationEmaFactor)*previous
+			}
+			currentEma[task.TaskID] = ema
+			fields["duration_ema"] = ema
+		}
+
+		if g.DurationSummaryField {
+			if summary := durationSummary(fields); summary != "" {
+				fields["duration_summary"] = summary
+			}
+		}
+
+		// Percentiles are passed on in seconds, as ereb reports them
+		if task.Stats.DurationP50 != nil {
+			fields["duration_p50"] = *task.Stats.DurationP50
+		}
+		if task.Stats.DurationP95 != nil {
+			fields["duration_p95"] = *task.Stats.DurationP95
+		}
+		if task.Stats.DurationP99 != nil {
+			fields["duration_p99"] = *task.Stats.DurationP99
+		}
+
+		acc.AddFields("ereb_tasks", g.renameFields(fields), tags, now)
+
+		if task.Enabled && task.Stats.LastRun != nil {
+			if idle, ok := overdueSeconds(task.CronSchedule, *task.Stats.LastRun, now); ok && idle > longestIdle {
+				longestIdle = idle
+				longestIdleTag = taskTag
+				longestIdleName = task.Name
+			}
+		}
+	}
+
+	if currentEma != nil {
+		g.durationEmaMu.Lock()
+		if g.durationEma == nil {
+			g.durationEma = make(map[string]map[string]float64)
+		}
+		g.durationEma[s.url.String()] = currentEma
+		g.durationEmaMu.Unlock()
+	}
+
+	if longestIdleTag != "" {
+		tags := s.tags()
+		tags["task_tag"] = longestIdleTag
+		fields := map[string]interface{}{
+			"task_name":    longestIdleName,
+			"idle_seconds": longestIdle,
+		}
+		acc.AddFields("ereb_longest_idle_task", g.renameFields(fields), tags, now)
+	}
+
+	return nil
+}
+
+// taskNameCounts counts the tasks of a server by name.
+func taskNameCounts(erebTasks ErebTasks) map[string]int {
+	names := make(map[string]int, len(erebTasks))
+	for _, task := range erebTasks {
+		names[task.Name]++
+	}
+	return names
+}
+
+// taskTagFor returns the task_tag of a task, its name followed by its ID when
+// other tasks share the name, as they would end up in the same series.
+func taskTagFor(name, taskID string, names map[string]int) string {
+	if names[name] > 1 {
+		return name + "_" + taskID
+	}
+	return name
+}
+
+// durationSummary joins the millisecond durations among fields into a single
+// "min=..,avg=..,max=.." string, leaving out those ereb did not report.
+func durationSummary(fields map[string]interface{}) string {
+	var parts []string
+	for _, name := range []string{"min", "avg", "max"} {
+		if ms, ok := fields[name + "_duration_ms"].(float64); ok {
+			parts = append(parts, name + "=" + strconv.FormatFloat(ms, 'f', -1, 64))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// overdueSeconds returns for how long a task has been missing the run its
+// cron schedule expected after its last run, 0 when it is not late.
+func overdueSeconds(schedule string, lastRun float64, now time.Time) (float64, bool) {
+	if schedule == "" {
+		return 0, false
+	}
+	sched, err := cron.ParseStandard(schedule)
+	if err != nil {
+		return 0, false
+	}
+
+	expected := sched.Next(time.Unix(0, int64(lastRun*float64(time.Second))))
+	if !now.After(expected) {
+		return 0, true
+	}
+	return now.Sub(expected).Seconds(), true
+}
+
+
+// exitCodeSummary is what is derived from the exit code history of a task.
+type exitCodeSummary struct {
+	lastExitCode string
+	// Failed runs since the last successful one
+	lastErrorsCount int
+	// A task has run once it has at least one completed run;
+	// a trailing "None" means the latest run is still in progress
+	hasRun bool
+	// Share of failed runs among the numeric exit codes
+	errorRate float64
+	// Number of different exit codes of completed runs
+	distinctExitCodes int
+}
+
+func (g *Ereb) summarizeExitCodes(taskName string, exitCodes []string) exitCodeSummary {
+	summary := exitCodeSummary{}
+
+	// If we don't have stats for this task,
+	// maybe it has been disabled
+	if len(exitCodes) == 0 {
+		summary.lastExitCode = "-1"
+		return summary
+	}
+
+	summary.lastExitCode = exitCodes[len(exitCodes)-1]
+
+	numericCodes := 0
+	failedCodes := 0
+	distinct := make(map[string]bool)
+
+	// Count non-zero exit codes
+	for _, exitCode := range exitCodes {
+		if exitCode != "None" {
+			summary.hasRun = true
+			distinct[exitCode] = true
+			intExitCode, err := strconv.Atoi(exitCode)
+			g.debug(taskName + ", " + exitCode + ", " + strconv.Itoa(intExitCode))
+			if err == nil {
+				numericCodes++
+				if intExitCode != 0 {
+					failedCodes++
+				}
+			}
+			// Only a numeric 0 is a success, negative codes and
+			// signal names such as "SIGKILL" are failures too
+			if err == nil && intExitCode == 0 {
+				summary.lastErrorsCount = 0
+			} else {
+				summary.lastErrorsCount++
+			}
+		}
+	}
+
+	if numericCodes > 0 {
+		summary.errorRate = float64(failedCodes) / float64(numericCodes)
+	}
+	summary.distinctExitCodes = len(distinct)
+
+	return summary
+}
+
+func gatherRecentRuns(g *Ereb, s *server, acc telegraf.Accumulator) error {
+	serverAddr := s.url.Redacted()
+	g.debug("Gathering recent runs for " + serverAddr)
+	now := time.Now()
+	erebRecentRuns := ErebRecentRuns{}
+	err := g.getJson(s, g.RecentRunsPath, &erebRecentRuns)
+	if err != nil {
+		return err
+	}
+
+	// The feed is chronological, keep only the latest runs
+	if g.MaxRecentRuns > 0 && len(erebRecentRuns) > g.MaxRecentRuns {
+		erebRecentRuns = erebRecentRuns[len(erebRecentRuns)-g.MaxRecentRuns:]
+	}
+
+	for _, run := range erebRecentRuns {
+		tags := s.tags()
+		tags["task_tag"] = run.Name
+
+		fields := map[string]interface{}{
+			"run_uuid":    run.TaskRunUUID,
+			"exit_code":   run.ExitCode,
+			"duration_ms": durationMs(run.Duration),
+		}
+
+		// Several runs of the same task share a series,
+		// so stamp each point with the time the run finished
+		runTime := now
+		if run.FinishedAt > 0 {
+			runTime = time.Unix(0, int64(run.FinishedAt*float64(time.Second)))
+		}
+
+		acc.AddFields("ereb_recent_runs", g.renameFields(fields), tags, runTime)
+	}
+
+	return nil
+}
+
+func gatherGroups(g *Ereb, s *server, acc telegraf.Accumulator) error {
+	serverAddr := s.url.Redacted()
+	g.debug("Gathering groups for " + serverAddr)
+	now := time.Now()
+	erebTasks, err := g.fetchTasks(s)
+	if err != nil {
+		// Already reported by gatherTasks when it runs as well
+		if s.tasksReported {
+			return nil
+		}
+		return err
+	}
+
+	type groupStats struct {
+		successCount int64
+		errorsCount  int64
+		tasksCount   int64
+	}
+
+	groups := make(map[string]*groupStats)
+	for _, task := range erebTasks {
+		if !task.Enabled && !g.IncludeDisabledTasks {
+			continue
+		}
+		stats, ok := groups[task.Group]
+		if !ok {
+			stats = &groupStats{}
+			groups[task.Group] = stats
+		}
+		stats.successCount += task.Stats.Success
+		stats.errorsCount += task.Stats.Error
+		stats.tasksCount++
+	}
+
+	for group, stats := range groups {
+		tags := s.tags()
+		tags["group"] = group
+
+		fields := map[string]interface{}{
+			"success_count": stats.successCount,
+			"errors_count":  stats.errorsCount,
+			"tasks_count":   stats.tasksCount,
+		}
+
+		acc.AddFields("ereb_groups", g.renameFields(fields), tags, now)
+	}
+
+	return nil
+}
+
+// gatherFailureLogs emits the end of the log of the last run of every task
+// whose latest run failed.
+func gatherFailureLogs(g *Ereb, s *server, acc telegraf.Accumulator) error {
+	serverAddr := s.url.Redacted()
+	g.debug("Gathering failure logs for " + serverAddr)
+	now := time.Now()
+	erebTasks, err := g.fetchTasks(s)
+	if err != nil {
+		// Already reported by gatherTasks when it runs as well
+		if s.tasksReported {
+			return nil
+		}
+		return err
+	}
+
+	basePath := g.basePaths(s)[0]
+	names := taskNameCounts(erebTasks)
+
+	var errs []error
+	for _, task := range erebTasks {
+		codes := g.summarizeExitCodes(task.Name, task.Stats.ExitCodes)
+		if codes.lastErrorsCount == 0 {
+			continue
+		}
+
+		// The task ID is escaped in the raw path only, Path holds it as it is
+		endpoint := s.endpoint(basePath + g.TasksPath + "/" + task.TaskID + "/last_run/log")
+		endpoint.RawPath = s.endpoint(basePath + g.TasksPath).EscapedPath() + "/" + url.PathEscape(task.TaskID) + "/last_run/log"
+		taskLog, err := g.fetchLogTail(s, endpoint)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		tags := s.tags()
+		tags["task_tag"] = taskTagFor(task.Name, task.TaskID, names)
+		fields := map[string]interface{}{
+			"log":            taskLog,
+			"last_exit_code": codes.lastExitCode,
+		}
+		acc.AddFields("ereb_task_failures", g.renameFields(fields), tags, now)
+	}
+
+	return errors.Join(errs...)
+}
+
+// fetchLogTail returns the last FailureLogSize bytes of the log at endpoint,
+// or of MaxBodySize bytes when it is not set. The whole log is read, only its
+// tail is kept in memory.
+func (g *Ereb) fetchLogTail(s *server, endpoint *url.URL) (string, error) {
+	res, err := g.doRequest(context.Background(), s, "GET", endpoint, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	size := int(g.FailureLogSize)
+	if size <= 0 {
+		size = int(g.MaxBodySize)
+	}
+	if size <= 0 {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return "", &ConnectError{URL: endpoint.String(), Err: err}
+		}
+		return string(body), nil
+	}
+
+	tail := &tailWriter{size: size}
+	if _, err := io.Copy(tail, res.Body); err != nil {
+		return "", &ConnectError{URL: endpoint.String(), Err: err}
+	}
+
+	body := tail.buf
+	if tail.truncated {
+		// Do not start in the middle of a multi-byte character
+		for len(body) > 0 && !utf8.RuneStart(body[0]) {
+			body = body[1:]
+		}
+	}
+	return string(body), nil
+}
+
+// tailWriter keeps the last size bytes written to it.
+type tailWriter struct {
+	size      int
+	buf       []byte
+	truncated bool
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) >= w.size {
+		w.truncated = w.truncated || len(w.buf) > 0 || len(p) > w.size
+		w.buf = append(w.buf[:0], p[len(p)-w.size:]...)
+		return n, nil
+	}
+	if over := len(w.buf) + len(p) - w.size; over > 0 {
+		w.truncated = true
+		w.buf = append(w.buf[:0], w.buf[over:]...)
+	}
+	w.buf = append(w.buf, p...)
+	return n, nil
+}
+
+// fetchStatus returns the /status of a server, requesting it only once per
+// gather however many gather functions need it.
+func (g *Ereb) fetchStatus(s *server) (*ErebStatus, error) {
+	s.statusOnce.Do(func() {
+		doc := &statusDocument{status: &s.status}
+		if len(g.StatusFields) > 0 {
+			doc.fields = make(map[string]interface{})
+		}
+		s.statusErr = g.getJson(s, g.StatusPath, doc)
+		s.statusFields = doc.fields
+	})
+	return &s.status, s.statusErr
+}
+
+// statusDocument decodes /status into ErebStatus and, when fields is set,
+// into a generic map as well for the keys ErebStatus does not have.
+type statusDocument struct {
+	status *ErebStatus
+	fields map[string]interface{}
+}
+
+func (d *statusDocument) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, d.status); err != nil {
+		return err
+	}
+	if d.fields == nil {
+		return nil
+	}
+	return json.Unmarshal(data, &d.fields)
+}
+
+// fetchTasks returns the /tasks list of a server, requesting it only once per
+// gather however many gather functions need it.
+func (g *Ereb) fetchTasks(s *server) (ErebTasks, error) {
+	s.tasksOnce.Do(func() {
+		doc := &tasksDocument{tasks: &s.tasks}
+		s.tasksErr = g.getJson(s, g.TasksPath, doc)
+		s.tasksCount = doc.count
+	})
+	return s.tasks, s.tasksErr
+}
+
+// tasksDocument decodes /tasks, either the bare list of older ereb versions
+// or the {"tasks": [...], "count": N} object of newer ones.
+type tasksDocument struct {
+	tasks *ErebTasks
+	count *int
+}
+
+func (d *tasksDocument) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		return json.Unmarshal(trimmed, d.tasks)
+	}
+
+	var wrapped struct {
+		Tasks ErebTasks `json:"tasks"`
+		Count *int      `json:"count"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return err
+	}
+	*d.tasks = wrapped.Tasks
+	d.count = wrapped.Count
+	return nil
+}
+
+// httpClient returns the client for requests, the injected Client or else
+// the default one, created once. Gather functions run concurrently, so this
+// must not race.
+func (g *Ereb) httpClient() *http.Client {
+	if g.Client != nil {
+		return g.Client
+	}
+	g.clientOnce.Do(func() {
+		// Timeouts are set on each request, as servers may override them
+		tr := &http.Transport{
+			DialContext:           dialContext,
+			MaxIdleConns:          g.MaxIdleConns,
+			IdleConnTimeout:       time.Duration(g.IdleConnTimeout),
+			// A custom transport only negotiates HTTP/2 when asked to
+			ForceAttemptHTTP2: !g.ForceHTTP1,
+		}
+		if g.ForceHTTP1 {
+			// A non-nil empty map turns HTTP/2 off
+			tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		}
+		g.client = &http.Client{Transport: tr}
+		if !g.FollowRedirects {
+			// The redirect itself is then returned as a *StatusError
+			g.client.CheckRedirect = func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			}
+		}
+	})
+	return g.client
+}
+
+// Request sends a request with the given method to path on the ereb server
+// at address, using the plugin's client and the credentials configured for
+// that server. It is meant for integrations driving ereb's control endpoints.
+// Non-200 responses, 304 included, are returned as a *StatusError, otherwise
+// the caller must close the response body.
+func (g *Ereb) Request(method, address, path string, body io.Reader) (*http.Response, error) {
+	s, err := g.serverFor(address)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := s.endpoint(path)
+	res, err := g.doRequest(context.Background(), s, method, endpoint, body, nil)
+	if err != nil {
+		return nil, err
+	}
+	// doRequest lets 304 through for the ETag cache, but no If-None-Match
+	// was sent here
+	if res.StatusCode == http.StatusNotModified {
+		res.Body.Close()
+		return nil, &StatusError{URL: endpoint.String(), Code: res.StatusCode}
+	}
+	return res, nil
+}
+
+// GatherCollector runs the single collector name, such as "status", against
+// the server at address and adds its metrics to acc, bypassing the
+// concurrency of Gather. Errors are returned rather than added to acc, so
+// tests can drive one collector against an httptest.Server.
+func (g *Ereb) GatherCollector(name, address string, acc telegraf.Accumulator) error {
+	gather, ok := gatherFunctions()[name]
+	if !ok {
+		return fmt.Errorf("Unknown collector '%s'", name)
+	}
+
+	s, err := g.serverFor(address)
+	if err != nil {
+		return err
+	}
+	s.acc = acc
+	s.tasksReported = name == "tasks"
+	return gather(g, s, acc)
+}
+
+// serverFor returns the server at address, with the credentials of the
+// matching server table if there is one.
+func (g *Ereb) serverFor(address string) (*server, error) {
+	sc := ServerConfig{URL: address}
+	for _, c := range g.ServerConfigs {
+		if c.URL == address {
+			sc = c
+		}
+	}
+
+	s, err := newServer(sc)
+	if err != nil {
+		return nil, err
+	}
+	if s.socket != "" && g.Client != nil {
+		return nil, socketClientError(address)
+	}
+	g.applyNetrc(s)
+	return s, nil
+}
+
+// socketClientError reports a Unix socket server configured along with a
+// custom Client, which would dial it as a TCP host.
+func socketClientError(address string) error {
+	return fmt.Errorf("Unable to gather from Unix socket server '%s' with a custom Client", redactURL(address))
+}
+
+// doRequest sends a request to endpoint on the server s with the extra header,
+// within the timeout of that server. Responses other than 200 and 304 are
+// turned into a *StatusError, otherwise the caller must close the body.
+func (g *Ereb) doRequest(parent context.Context, s *server, method string, endpoint *url.URL, body io.Reader, header http.Header) (*http.Response, error) {
+	timeout := g.serverTimeout(s)
+	ctx, cancel := context.WithCancel(parent)
+	if timeout > 0 {
+		cancel()
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	}
+
+	res, err := g.doRequestContext(ctx, s, method, endpoint, body, header)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The deadline also covers reading the body
+	res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// serverTimeout returns the timeout of requests to s, 0 for none.
+func (g *Ereb) serverTimeout(s *server) time.Duration {
+	if s.timeout > 0 {
+		return s.timeout
+	}
+	return time.Duration(g.Timeout)
+}
+
+// cancelBody releases the context of a request once its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (g *Ereb) doRequestContext(ctx context.Context, s *server, method string, endpoint *url.URL, body io.Reader, header http.Header) (*http.Response, error) {
+	requestUrl := endpoint.String()
+
+	// The body is kept to send it again when answering an auth challenge
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = ioutil.ReadAll(body); err != nil {
+			return nil, err
+		}
+	}
+
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, requestUrl, bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("Unable parse server address '%s': %s", requestUrl, err)
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		return req, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer " + s.token)
+	} else if s.username != "" && !g.DigestAuth {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	res, err := g.httpClient().Do(req)
+	if err != nil {
+		return nil, &ConnectError{URL: requestUrl, Err: err}
+	}
+
+	if res.StatusCode == http.StatusUnauthorized && g.DigestAuth && s.username != "" {
+		scheme, params := parseChallenge(res.Header.Get("WWW-Authenticate"))
+		if strings.EqualFold(scheme, "Digest") {
+			res.Body.Close()
+
+			req, err = newRequest()
+			if err != nil {
+				return nil, err
+			}
+			authorization, err := digestAuthorization(s.username, s.password, req, params)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to answer the Digest challenge of '%s': %s", requestUrl, err)
+			}
+			req.Header.Set("Authorization", authorization)
+
+			res, err = g.httpClient().Do(req)
+			if err != nil {
+				return nil, &ConnectError{URL: requestUrl, Err: err}
+			}
+		}
+	}
+
+	// Without credentials for the realm, the 401 is returned as it is
+	if res.StatusCode == http.StatusUnauthorized && len(g.RealmCredentials) > 0 {
+		scheme, params := parseChallenge(res.Header.Get("WWW-Authenticate"))
+		if creds, ok := g.RealmCredentials[params["realm"]]; ok && strings.EqualFold(scheme, "Basic") {
+			res.Body.Close()
+
+			password, err := secretString(&creds.Password)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to get password of realm '%s': %s", params["realm"], err)
+			}
+			req, err = newRequest()
+			if err != nil {
+				return nil, err
+			}
+			req.SetBasicAuth(creds.Username, password)
+
+			res, err = g.httpClient().Do(req)
+			if err != nil {
+				return nil, &ConnectError{URL: requestUrl, Err: err}
+			}
+		}
+	}
+
+	if res.StatusCode != 200 && res.StatusCode != http.StatusNotModified {
+		defer res.Body.Close()
+		// ereb usually explains failures in the body, keep a bounded part of it
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBodySize))
+		statusErr := StatusError{URL: requestUrl, Code: res.StatusCode, Body: strings.TrimSpace(string(body))}
+		if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+			return nil, &AuthError{statusErr}
+		}
+		return nil, &statusErr
+	}
+
+	return res, nil
+}
+
+// parseChallenge splits a WWW-Authenticate header into its scheme and
+// parameters, such as realm and nonce.
+func parseChallenge(header string) (string, map[string]string) {
+	params := make(map[string]string)
+
+	header = strings.TrimSpace(header)
+	i := strings.IndexByte(header, ' ')
+	if i < 0 {
+		return header, params
+	}
+	scheme, rest := header[:i], header[i+1:]
+
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			// Quoted values may contain commas and escaped quotes
+			var b strings.Builder
+			j := 1
+			for ; j < len(rest) && rest[j] != '"'; j++ {
+				if rest[j] == '\\' && j+1 < len(rest) {
+					j++
+				}
+				b.WriteByte(rest[j])
+			}
+			value = b.String()
+			if j < len(rest) {
+				j++
+			}
+			rest = rest[j:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value = strings.TrimSpace(rest[:end])
+			rest = rest[end:]
+		}
+		params[key] = value
+	}
+
+	return scheme, params
+}
+
+// digestAuthorization answers a Digest challenge (RFC 2617) for req, using
+// the "auth" quality of protection when the server offers it. Only the MD5
+// algorithm is supported, other challenges are refused rather than answered
+// with a response the server would reject.
+func digestAuthorization(username, password string, req *http.Request, params map[string]string) (string, error) {
+	algorithm, hasAlgorithm := params["algorithm"]
+	if hasAlgorithm && !strings.EqualFold(algorithm, "MD5") {
+		return "", fmt.Errorf("unsupported digest algorithm '%s'", algorithm)
+	}
+
+	md5hex := func(data string) string {
+		sum := md5.Sum([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+
+	realm, nonce := params["realm"], params["nonce"]
+	uri := req.URL.RequestURI()
+
+	ha1 := md5hex(username + ":" + realm + ":" + password)
+	ha2 := md5hex(req.Method + ":" + uri)
+
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, username, realm, nonce, uri)
+
+	qopAuth := false
+	for _, qop := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(qop) == "auth" {
+			qopAuth = true
+		}
+	}
+
+	if qopAuth {
+		cnonceBytes := make([]byte, 8)
+		if _, err := crand.Read(cnonceBytes); err != nil {
+			return "", err
+		}
+		cnonce := hex.EncodeToString(cnonceBytes)
+		nc := "00000001"
+		response := md5hex(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+		header += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s", response="%s"`, nc, cnonce, response)
+	} else {
+		header += fmt.Sprintf(`, response="%s"`, md5hex(ha1 + ":" + nonce + ":" + ha2))
+	}
+
+	if hasAlgorithm {
+		header += ", algorithm=" + algorithm
+	}
+	if opaque, ok := params["opaque"]; ok {
+		header += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+
+	return header, nil
+}
+
+// basePaths returns the base paths to try for the server s, starting with the
+// one that worked last time.
+func (g *Ereb) basePaths(s *server) []string {
+	if len(g.BasePaths) == 0 {
+		return []string{""}
+	}
+
+	g.basePathMu.Lock()
+	known, ok := g.basePath[s.url.String()]
+	g.basePathMu.Unlock()
+
+	if !ok {
+		return g.BasePaths
+	}
+	paths := []string{known}
+	for _, p := range g.BasePaths {
+		if p != known {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+func (g *Ereb) rememberBasePath(s *server, basePath string) {
+	g.basePathMu.Lock()
+	defer g.basePathMu.Unlock()
+	if g.basePath == nil {
+		g.basePath = make(map[string]string)
+	}
+	g.basePath[s.url.String()] = basePath
+}
+
+// getJson requests path on the server s and decodes the JSON response into
+// target, falling back through the configured base paths on 404.
+func (g *Ereb) getJson(s *server, path string, target interface{}) error {
+	var err error
+	for _, basePath := range g.basePaths(s) {
+		err = g.getJsonRetrying(s, s.endpoint(basePath + path), target)
+
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound {
+			g.debug(err.Error())
+			continue
+		}
+		if err == nil {
+			g.rememberBasePath(s, basePath)
+		}
+		return err
+	}
+	return err
+}
+
+// requestTrace records when the phases of a request happened. A reused
+// connection skips DNS, connect and TLS, their fields are then left out.
+type requestTrace struct {
+	mu           sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	firstByte    time.Time
+}
+
+// clientTrace returns the hooks filling in t. They may be called from the
+// goroutines dialing the connection, hence the mutex.
+func (t *requestTrace) clientTrace() *httptrace.ClientTrace {
+	record := func(at *time.Time) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if at.IsZero() {
+			*at = time.Now()
+		}
+	}
+	return &httptrace.ClientTrace{
+		GetConn:              func(string) { record(&t.start) },
+		DNSStart:             func(httptrace.DNSStartInfo) { record(&t.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { record(&t.dnsDone) },
+		ConnectStart:         func(string, string) { record(&t.connectStart) },
+		ConnectDone:          func(string, string, error) { record(&t.connectDone) },
+		TLSHandshakeStart:    func() { record(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { record(&t.tlsDone) },
+		GotFirstResponseByte: func() { record(&t.firstByte) },
+	}
+}
+
+// addFields adds the duration of each recorded phase to fields.
+func (t *requestTrace) addFields(fields map[string]interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	phase := func(name string, from, to time.Time) {
+		if !from.IsZero() && !to.IsZero() {
+			fields[name] = durationMs(to.Sub(from).Seconds())
+		}
+	}
+	phase("dns_ms", t.dnsStart, t.dnsDone)
+	phase("connect_ms", t.connectStart, t.connectDone)
+	phase("tls_ms", t.tlsStart, t.tlsDone)
+	phase("ttfb_ms", t.start, t.firstByte)
+}
+
+// retryBackoff is the wait before the first retry, growing with each one.
+const retryBackoff = 500 * time.Millisecond
+
+// getJsonRetrying is getJsonAt, retried up to Retries times on transient
+// failures. The timeout of the server bounds all attempts together, within
+// the deadline of the gather if there is one.
+func (g *Ereb) getJsonRetrying(s *server, endpoint *url.URL, target interface{}) error {
+	ctx := context.Background()
+	if s.ctx != nil {
+		ctx = s.ctx
+	}
+	if timeout := g.serverTimeout(s); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	retries := g.Retries
+	if method := g.requestMethod(); method != "GET" && method != "HEAD" && !g.RetryNonIdempotent {
+		retries = 0
+	}
+
+	err := g.getJsonAt(ctx, s, endpoint, target)
+	for attempt := 1; attempt <= retries && g.retryable(err); attempt++ {
+		g.debug("Retrying after " + err.Error())
+		select {
+		case <-time.After(time.Duration(attempt) * retryBackoff):
+		case <-ctx.Done():
+			return err
+		}
+		err = g.getJsonAt(ctx, s, endpoint, target)
+	}
+	return err
+}
+
+// requestMethod returns the method of the requests gathering metrics.
+func (g *Ereb) requestMethod() string {
+	if g.RequestMethod == "" {
+		return "GET"
+	}
+	return g.RequestMethod
+}
+
+// retryable tells whether a request failing with err may succeed when sent
+// again: connection errors and the configured status codes.
+func (g *Ereb) retryable(err error) bool {
+	var connectErr *ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		for _, code := range g.RetryableStatusCodes {
+			if statusErr.Code == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cachedResponse is a response body kept along with its ETag.
+type cachedResponse struct {
+	etag string
+	body []byte
+}
+
+func (g *Ereb) getJsonAt(ctx context.Context, s *server, endpoint *url.URL, target interface{}) error {
+	requestUrl := endpoint.String()
+
+	method := g.requestMethod()
+
+	header := http.Header{}
+	var payload io.Reader
+	if g.RequestBody != "" {
+		header.Set("Content-Type", "application/json")
+		payload = strings.NewReader(g.RequestBody)
+	}
+
+	// Ask for the body only if it changed since the last time
+	cached, isCached := cachedResponse{}, false
+	if method == "GET" {
+		g.cacheMu.Lock()
+		cached, isCached = g.cache[requestUrl]
+		g.cacheMu.Unlock()
+	}
+	if isCached {
+		header.Set("If-None-Match", cached.etag)
+	}
+
+	var trace *requestTrace
+	if g.Trace {
+		trace = &requestTrace{}
+		ctx = httptrace.WithClientTrace(ctx, trace.clientTrace())
+	}
+
+	res, err := g.doRequest(ctx, s, method, endpoint, payload, header)
+	if err != nil {
+		return err
+	}
+	s.followedRedirect(res, endpoint)
+
+	defer res.Body.Close()
+
+	var reader io.Reader = res.Body
+	if g.MaxBodySize > 0 {
+		// One byte over the limit tells a body of exactly the limit apart
+		reader = io.LimitReader(res.Body, int64(g.MaxBodySize)+1)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return &ConnectError{URL: requestUrl, Err: err}
+	}
+	if g.MaxBodySize > 0 && int64(len(body)) > int64(g.MaxBodySize) {
+		return &DecodeError{URL: requestUrl, Err: fmt.Errorf("response larger than max_body_size of %d bytes", int64(g.MaxBodySize))}
+	}
+	received := len(body)
+
+	if res.StatusCode == http.StatusNotModified {
+		if !isCached {
+			return &StatusError{URL: requestUrl, Code: res.StatusCode}
+		}
+		body = cached.body
+	} else if etag := res.Header.Get("ETag"); etag != "" && method == "GET" {
+		g.cacheMu.Lock()
+		if g.cache == nil {
+			g.cache = make(map[string]cachedResponse)
+		}
+		g.cache[requestUrl] = cachedResponse{etag: etag, body: body}
+		g.cacheMu.Unlock()
+	}
+
+	if (g.GatherInternalMetrics || g.Trace) && s.acc != nil {
+		tags := s.tags()
+		tags["endpoint"] = strings.TrimPrefix(endpoint.Path, s.url.Path)
+		fields := map[string]interface{}{"response_bytes": received}
+		if trace != nil {
+			trace.addFields(fields)
+		}
+		s.acc.AddFields("ereb_request", fields, tags, time.Now())
+	}
+
+	if err := json.Unmarshal(body, target); err != nil {
+		return &DecodeError{URL: requestUrl, Err: err}
+	}
 
 	return nil
 }
 
 func init() {
 	inputs.Add("ereb", func() telegraf.Input {
-		return &ereb{}
+		return New()
 	})
 }
\ No newline at end of file
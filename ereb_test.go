@@ -0,0 +1,1907 @@
+package ereb_telegraf
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+const statusFixture = `{
+	"next_run": 12.5,
+	"state": "running",
+	"next_tasks": [{"name": "backup", "task_id": "1", "enabled": true}],
+	"planned_task_run_uuids": []
+}`
+
+const tasksFixture = `[{
+	"name": "backup",
+	"task_id": "1",
+	"enabled": true,
+	"group": "daily",
+	"timeout": "60",
+	"shell_scripts": ["backup.sh"],
+	"stats": {
+		"duration_avg": 1.5,
+		"duration_max": 2,
+		"duration_min": 1,
+		"error": 1,
+		"success": 4,
+		"exit_codes": ["0", "1", "0"]
+	}
+}]`
+
+// fixture answers every request with body.
+func fixture(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}
+}
+
+// newTestServer starts an ereb stand-in serving the given handlers by path,
+// /status and /tasks answering the fixtures above unless overridden.
+func newTestServer(t *testing.T, handlers map[string]http.HandlerFunc) *httptest.Server {
+	mux := http.NewServeMux()
+	routes := map[string]http.HandlerFunc{
+		"/status": fixture(statusFixture),
+		"/tasks":  fixture(tasksFixture),
+	}
+	for path, handler := range handlers {
+		routes[path] = handler
+	}
+	for path, handler := range routes {
+		mux.HandleFunc(path, handler)
+	}
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// serverTags returns tags along with the hostname and port tags of ts.
+func serverTags(ts *httptest.Server, tags map[string]string) map[string]string {
+	u, _ := url.Parse(ts.URL)
+	result := map[string]string{"hostname": u.Hostname(), "port": u.Port()}
+	for key, value := range tags {
+		result[key] = value
+	}
+	return result
+}
+
+func TestGatherStatus(t *testing.T) {
+	ts := newTestServer(t, nil)
+	g := New()
+
+	var acc testutil.Accumulator
+	if err := g.GatherCollector("status", ts.URL, &acc); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := map[string]interface{}{
+		"running":             1,
+		"paused":              0,
+		"tasks_queue_length":  1,
+		"enabled_queue_ratio": 1.0,
+		"next_run_in":         12.5,
+		"next_run_overdue":    false,
+		"next_run_imminent":   1,
+		"tasks_seen":          1,
+		"enabled_tasks":       1,
+		"failing_tasks":       0,
+		"manual_tasks":        1,
+		"tasks_added":         0,
+		"tasks_removed":       0,
+	}
+	tags := serverTags(ts, nil)
+	acc.AssertContainsTaggedFields(t, "ereb_status", fields, tags)
+}
+
+func TestGatherTasks(t *testing.T) {
+	ts := newTestServer(t, nil)
+	g := New()
+
+	var acc testutil.Accumulator
+	if err := g.GatherCollector("tasks", ts.URL, &acc); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := map[string]interface{}{
+		"task_name":              "backup",
+		"enabled":                true,
+		"success_count":          int64(4),
+		"errors_count":           int64(1),
+		"timeout":                60,
+		"last_exit_code":         "0",
+		"last_errors_count":      0,
+		"has_run":                true,
+		"exit_code_error_rate":   1.0 / 3,
+		"timeout_exceeded":       false,
+		"error_ratio":            0.25,
+		"distinct_exit_codes":    2,
+		"unhealthy":              false,
+		"has_stats":              true,
+		"exit_code_history_len":  3,
+		"scheduled":              false,
+		"enabled_scripts_count":  1,
+		"enabled_scripts":        "backup.sh",
+		"retrying":               false,
+		"seconds_since_last_run": -1.0,
+		"avg_duration_ms":        1500.0,
+		"avg_duration":           1.5,
+		"max_duration_ms":        2000.0,
+		"max_duration":           int64(2),
+		"min_duration_ms":        1000.0,
+		"min_duration":           int64(1),
+	}
+	tags := serverTags(ts, map[string]string{"task_tag": "backup"})
+	acc.AssertContainsTaggedFields(t, "ereb_tasks", fields, tags)
+}
+
+func TestInitLeavesReachabilityToProbe(t *testing.T) {
+	ts := newTestServer(t, nil)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	g := New(ts.URL, down.URL)
+	g.NetrcFile = "/nonexistent"
+	if err := g.Init(); err != nil {
+		t.Fatalf("Init failed with a server down: %s", err)
+	}
+
+	err := g.Probe()
+	if err == nil {
+		t.Fatal("Probe succeeded with a server down")
+	}
+	if !strings.Contains(err.Error(), down.URL) {
+		t.Errorf("Probe error does not name the server that is down: %s", err)
+	}
+
+	if err := New(ts.URL).Probe(); err != nil {
+		t.Errorf("Probe failed with the server up: %s", err)
+	}
+}
+
+const recentRunsFixture = `[
+	{"task_id": "1", "name": "backup", "uuid": "r1", "exit_code": "0", "duration": 1.5, "started_at": 1700000000, "finished_at": 1700000001.5},
+	{"task_id": "2", "name": "cleanup", "uuid": "r2", "exit_code": "1", "duration": 0.25, "started_at": 1700000060, "finished_at": 1700000060.25},
+	{"task_id": "1", "name": "backup", "uuid": "r3", "exit_code": "0", "duration": 2, "started_at": 1700000120, "finished_at": 1700000122}
+]`
+
+func TestGatherRecentRuns(t *testing.T) {
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/api/recent": fixture(recentRunsFixture),
+	})
+	g := New()
+	g.RecentRunsPath = "/api/recent"
+	g.MaxRecentRuns = 2
+
+	var acc testutil.Accumulator
+	if err := g.GatherCollector("recent_runs", ts.URL, &acc); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := acc.NMetrics(); n != 2 {
+		t.Fatalf("expected the 2 latest runs, got %d points", n)
+	}
+	acc.AssertContainsTaggedFields(t, "ereb_recent_runs",
+		map[string]interface{}{"run_uuid": "r2", "exit_code": "1", "duration_ms": 250.0},
+		serverTags(ts, map[string]string{"task_tag": "cleanup"}))
+	acc.AssertContainsTaggedFields(t, "ereb_recent_runs",
+		map[string]interface{}{"run_uuid": "r3", "exit_code": "0", "duration_ms": 2000.0},
+		serverTags(ts, map[string]string{"task_tag": "backup"}))
+}
+
+func TestRecentRunsNotCollectedByDefault(t *testing.T) {
+	requested := false
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/task_runs/recent": func(w http.ResponseWriter, r *http.Request) {
+			requested = true
+			fmt.Fprint(w, recentRunsFixture)
+		},
+	})
+	g := New(ts.URL)
+
+	var acc testutil.Accumulator
+	if err := g.Gather(&acc); err != nil {
+		t.Fatal(err)
+	}
+	if requested {
+		t.Error("recent runs requested without being in collectors")
+	}
+	acc.AssertDoesNotContainMeasurement(t, "ereb_recent_runs")
+}
+
+const failingTasksFixture = `[
+	{"name": "backup", "task_id": "1", "enabled": true, "stats": {"exit_codes": ["0", "1"]}},
+	{"name": "backup", "task_id": "2", "enabled": true, "stats": {"exit_codes": ["2"]}}
+]`
+
+func TestGatherFailureLogsKeepsTail(t *testing.T) {
+	// A log larger than max_body_size, ending in multi-byte characters
+	log := strings.Repeat("x", 8192) + "ééé"
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/tasks":                fixture(failingTasksFixture),
+		"/tasks/1/last_run/log": fixture(log),
+		"/tasks/2/last_run/log": fixture("short log"),
+	})
+	g := New(ts.URL)
+	g.Collectors = []string{"tasks"}
+	g.FailureLogs = true
+	g.MaxBodySize = 4096
+	// Cuts the first é in half
+	g.FailureLogSize = 5
+
+	var acc testutil.Accumulator
+	if err := g.Gather(&acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := acc.FirstError(); err != nil {
+		t.Fatal(err)
+	}
+
+	acc.AssertContainsTaggedFields(t, "ereb_task_failures",
+		map[string]interface{}{"log": "éé", "last_exit_code": "1"},
+		serverTags(ts, map[string]string{"task_tag": "backup_1"}))
+	acc.AssertContainsTaggedFields(t, "ereb_task_failures",
+		map[string]interface{}{"log": "t log", "last_exit_code": "2"},
+		serverTags(ts, map[string]string{"task_tag": "backup_2"}))
+}
+
+func TestGatherFailureLogsSharesTasksError(t *testing.T) {
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/tasks": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "broken", http.StatusInternalServerError)
+		},
+	})
+	g := New(ts.URL)
+	g.Collectors = []string{"tasks"}
+	g.FailureLogs = true
+
+	var acc testutil.Accumulator
+	if err := g.Gather(&acc); err != nil {
+		t.Fatal(err)
+	}
+	if len(acc.Errors) != 1 {
+		t.Errorf("expected the /tasks failure to be reported once, got %v", acc.Errors)
+	}
+}
+
+func TestServerCredentialsAreNotExpanded(t *testing.T) {
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": func(w http.ResponseWriter, r *http.Request) {
+			if username, password, ok := r.BasicAuth(); !ok || username != "telegraf" || password != "$ecret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, statusFixture)
+		},
+	})
+	g := New()
+	g.NetrcFile = "/nonexistent"
+	g.Collectors = []string{"status"}
+	g.ServerConfigs = []ServerConfig{{URL: ts.URL, Username: "telegraf", Password: config.NewSecret([]byte("$ecret"))}}
+	if err := g.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var acc testutil.Accumulator
+	if err := g.GatherCollector("status", ts.URL, &acc); err != nil {
+		t.Fatal(err)
+	}
+	if !acc.HasMeasurement("ereb_status") {
+		t.Error("no ereb_status emitted")
+	}
+}
+
+// digestHandler challenges requests for Digest auth with algorithm, serving
+// the fixtures once a request answers the challenge for telegraf:secret.
+func digestHandler(algorithm string, body string) http.HandlerFunc {
+	md5hex := func(data string) string {
+		sum := md5.Sum([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		scheme, params := parseChallenge(r.Header.Get("Authorization"))
+		if scheme != "Digest" {
+			w.Header().Set("WWW-Authenticate", `Digest realm="ereb", nonce="abc", qop="auth", algorithm=`+algorithm)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		ha1 := md5hex("telegraf:ereb:secret")
+		ha2 := md5hex(r.Method + ":" + params["uri"])
+		expected := md5hex(ha1 + ":abc:" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+		if params["username"] != "telegraf" || params["response"] != expected {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, body)
+	}
+}
+
+func TestDigestAuth(t *testing.T) {
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": digestHandler("MD5", statusFixture),
+		"/tasks":  digestHandler("MD5", tasksFixture),
+	})
+	g := New()
+	g.DigestAuth = true
+
+	var acc testutil.Accumulator
+	if err := g.GatherCollector("status", "http://telegraf:secret@"+ts.Listener.Addr().String(), &acc); err != nil {
+		t.Fatal(err)
+	}
+	if !acc.HasMeasurement("ereb_status") {
+		t.Error("no ereb_status emitted")
+	}
+}
+
+func TestDigestAuthUnsupportedAlgorithm(t *testing.T) {
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": digestHandler("SHA-256", statusFixture),
+	})
+	g := New()
+	g.DigestAuth = true
+	g.Collectors = []string{"status"}
+
+	var acc testutil.Accumulator
+	err := g.GatherCollector("status", "http://telegraf:secret@"+ts.Listener.Addr().String(), &acc)
+	if err == nil || !strings.Contains(err.Error(), "unsupported digest algorithm 'SHA-256'") {
+		t.Errorf("expected the SHA-256 challenge to be refused, got %v", err)
+	}
+}
+
+// jitterServers returns n addresses of ts, gathered as different servers.
+func jitterServers(ts *httptest.Server, n int) []string {
+	servers := make([]string, n)
+	for i := range servers {
+		servers[i] = fmt.Sprintf("%s/?server=%d", ts.URL, i)
+	}
+	return servers
+}
+
+func TestScrapeJitterSpreadsRequests(t *testing.T) {
+	var mu sync.Mutex
+	var requested []time.Time
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requested = append(requested, time.Now())
+			mu.Unlock()
+			fmt.Fprint(w, statusFixture)
+		},
+	})
+
+	g := New(jitterServers(ts, 8)...)
+	g.NetrcFile = "/nonexistent"
+	g.Collectors = []string{"status"}
+	g.ScrapeJitter = config.Duration(100 * time.Millisecond)
+	if err := g.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	var acc testutil.Accumulator
+	if err := g.Gather(&acc); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requested) != 8 {
+		t.Fatalf("expected 8 requests, got %d", len(requested))
+	}
+	first, last := requested[0], requested[0]
+	for _, at := range requested {
+		// Leave some room for scheduling the goroutines
+		if delay := at.Sub(start); delay > 100*time.Millisecond+25*time.Millisecond {
+			t.Errorf("request delayed by %s, beyond the jitter", delay)
+		}
+		if at.Before(first) {
+			first = at
+		}
+		if at.After(last) {
+			last = at
+		}
+	}
+	if spread := last.Sub(first); spread < 20*time.Millisecond {
+		t.Errorf("requests spread over %s only", spread)
+	}
+}
+
+func TestScrapeJitterWithinTimeout(t *testing.T) {
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		},
+	})
+
+	g := New(jitterServers(ts, 8)...)
+	g.NetrcFile = "/nonexistent"
+	g.Collectors = []string{"status"}
+	g.BasePaths = []string{"/api/v2", ""}
+	g.Timeout = config.Duration(200 * time.Millisecond)
+	g.ScrapeJitter = config.Duration(190 * time.Millisecond)
+	if err := g.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	var acc testutil.Accumulator
+	if err := g.Gather(&acc); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond+50*time.Millisecond {
+		t.Errorf("gather took %s, beyond the timeout", elapsed)
+	}
+	if len(acc.Errors) != 8 {
+		t.Errorf("expected every server to time out, got %d errors", len(acc.Errors))
+	}
+}
+
+func TestScrapeJitterShorterThanTimeout(t *testing.T) {
+	g := New()
+	g.NetrcFile = "/nonexistent"
+	g.ScrapeJitter = config.Duration(10 * time.Second)
+	g.ServerConfigs = []ServerConfig{{URL: "http://ereb:8888", Timeout: config.Duration(5 * time.Second)}}
+
+	err := g.Init()
+	if err == nil || !strings.Contains(err.Error(), "scrape_jitter") {
+		t.Errorf("expected scrape_jitter beyond a server timeout to be rejected, got %v", err)
+	}
+}
+
+func TestGatherGroups(t *testing.T) {
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/tasks": fixture(`[
+			{"name": "backup", "task_id": "1", "enabled": true, "group": "daily", "stats": {"success": 4, "error": 1}},
+			{"name": "cleanup", "task_id": "2", "enabled": true, "group": "daily", "stats": {"success": 2, "error": 0}},
+			{"name": "report", "task_id": "3", "enabled": true, "group": "weekly", "stats": {"success": 1, "error": 3}}
+		]`),
+	})
+	g := New()
+
+	var acc testutil.Accumulator
+	if err := g.GatherCollector("groups", ts.URL, &acc); err != nil {
+		t.Fatal(err)
+	}
+
+	acc.AssertContainsTaggedFields(t, "ereb_groups",
+		map[string]interface{}{"success_count": int64(6), "errors_count": int64(1), "tasks_count": int64(2)},
+		serverTags(ts, map[string]string{"group": "daily"}))
+	acc.AssertContainsTaggedFields(t, "ereb_groups",
+		map[string]interface{}{"success_count": int64(1), "errors_count": int64(3), "tasks_count": int64(1)},
+		serverTags(ts, map[string]string{"group": "weekly"}))
+}
+
+func TestGatherGroupsSharesTasksError(t *testing.T) {
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/tasks": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "broken", http.StatusInternalServerError)
+		},
+	})
+	g := New(ts.URL)
+	g.Collectors = []string{"tasks", "groups"}
+
+	var acc testutil.Accumulator
+	if err := g.Gather(&acc); err != nil {
+		t.Fatal(err)
+	}
+	if len(acc.Errors) != 1 {
+		t.Errorf("expected the /tasks failure to be reported once, got %v", acc.Errors)
+	}
+
+	if err := g.GatherCollector("groups", ts.URL, &acc); err == nil {
+		t.Error("expected groups to report the /tasks failure when run alone")
+	}
+}
+
+func TestDuplicateServerKeepsTable(t *testing.T) {
+	requests := 0
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, statusFixture)
+		},
+	})
+	g := New(ts.URL)
+	g.Collectors = []string{"status"}
+	g.ServerConfigs = []ServerConfig{{URL: ts.URL, BearerToken: config.NewSecret([]byte("token"))}}
+
+	var acc testutil.Accumulator
+	if err := g.Gather(&acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := acc.FirstError(); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("expected the duplicate server to be gathered once, got %d requests", requests)
+	}
+}
+
+func TestSchedulerStateTag(t *testing.T) {
+	statusRequested := false
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": func(w http.ResponseWriter, r *http.Request) {
+			statusRequested = true
+			fmt.Fprint(w, statusFixture)
+		},
+	})
+	g := New()
+
+	var acc testutil.Accumulator
+	if err := g.GatherCollector("tasks", ts.URL, &acc); err != nil {
+		t.Fatal(err)
+	}
+	if statusRequested {
+		t.Error("/status requested without scheduler_state_tag")
+	}
+	if acc.HasTag("ereb_tasks", "scheduler_state") {
+		t.Error("scheduler_state tag set without scheduler_state_tag")
+	}
+
+	g.SchedulerStateTag = true
+	acc.ClearMetrics()
+	if err := g.GatherCollector("tasks", ts.URL, &acc); err != nil {
+		t.Fatal(err)
+	}
+	if state := acc.TagValue("ereb_tasks", "scheduler_state"); state != "running" {
+		t.Errorf("expected scheduler_state running, got %q", state)
+	}
+}
+
+// flakyHandler answers the first failures requests with code, then serves body.
+func flakyHandler(failures int, code int, body string, requests *int) http.HandlerFunc {
+	var mu sync.Mutex
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*requests++
+		n := *requests
+		mu.Unlock()
+		if n <= failures {
+			w.WriteHeader(code)
+			return
+		}
+		fmt.Fprint(w, body)
+	}
+}
+
+func TestRetryableStatusCodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		code     int
+		requests int
+		fails    bool
+	}{
+		{name: "retried status", method: "GET", code: http.StatusBadGateway, requests: 2},
+		{name: "permanent status", method: "GET", code: http.StatusNotFound, requests: 1, fails: true},
+		{name: "non-idempotent method", method: "POST", code: http.StatusBadGateway, requests: 1, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			ts := newTestServer(t, map[string]http.HandlerFunc{
+				"/status": flakyHandler(1, tt.code, statusFixture, &requests),
+			})
+			g := New()
+			g.Collectors = []string{"status"}
+			g.RequestMethod = tt.method
+			g.Retries = 2
+
+			var acc testutil.Accumulator
+			err := g.GatherCollector("status", ts.URL, &acc)
+			if tt.fails != (err != nil) {
+				t.Errorf("unexpected error %v", err)
+			}
+			if requests != tt.requests {
+				t.Errorf("expected %d requests, got %d", tt.requests, requests)
+			}
+		})
+	}
+}
+
+func TestRetriesShareTimeout(t *testing.T) {
+	requests := 0
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": flakyHandler(10, http.StatusServiceUnavailable, statusFixture, &requests),
+	})
+	g := New()
+	g.Collectors = []string{"status"}
+	g.Retries = 10
+	g.Timeout = config.Duration(200 * time.Millisecond)
+
+	start := time.Now()
+	var acc testutil.Accumulator
+	if err := g.GatherCollector("status", ts.URL, &acc); err == nil {
+		t.Fatal("expected the gather to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retries took %s, beyond the timeout", elapsed)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/tasks/1/run": func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			fmt.Fprint(w, `{"ok": true}`)
+		},
+		"/unchanged": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotModified)
+		},
+	})
+	g := New()
+
+	res, err := g.Request("POST", ts.URL, "/tasks/1/run", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	_, err = g.Request("GET", ts.URL, "/unchanged", nil)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusNotModified {
+		t.Errorf("expected a 304 *StatusError, got %v", err)
+	}
+}
+
+// gatherTasksFrom runs the tasks collector of g against a server answering
+// /tasks with tasks.
+func gatherTasksFrom(t *testing.T, g *Ereb, tasks string) *testutil.Accumulator {
+	t.Helper()
+	ts := newTestServer(t, map[string]http.HandlerFunc{"/tasks": fixture(tasks)})
+
+	var acc testutil.Accumulator
+	if err := g.GatherCollector("tasks", ts.URL, &acc); err != nil {
+		t.Fatal(err)
+	}
+	return &acc
+}
+
+// taskFields returns the fields of the ereb_tasks point tagged with taskTag.
+func taskFields(t *testing.T, acc *testutil.Accumulator, taskTag string) map[string]interface{} {
+	t.Helper()
+	for _, m := range acc.Metrics {
+		if m.Measurement == "ereb_tasks" && m.Tags["task_tag"] == taskTag {
+			return m.Fields
+		}
+	}
+	t.Fatalf("no ereb_tasks point for task %q", taskTag)
+	return nil
+}
+
+func TestHasRun(t *testing.T) {
+	tests := []struct {
+		name         string
+		exitCodes    string
+		lastExitCode string
+		hasRun       bool
+	}{
+		{name: "empty history", exitCodes: `[]`, lastExitCode: "-1", hasRun: false},
+		{name: "still running", exitCodes: `["None"]`, lastExitCode: "None", hasRun: false},
+		{name: "running after a run", exitCodes: `["0", "None"]`, lastExitCode: "None", hasRun: true},
+		{name: "normal code", exitCodes: `["0", "3"]`, lastExitCode: "3", hasRun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acc := gatherTasksFrom(t, New(), `[{"name": "backup", "task_id": "1", "enabled": true, "stats": {"exit_codes": `+tt.exitCodes+`}}]`)
+			fields := taskFields(t, acc, "backup")
+			if fields["last_exit_code"] != tt.lastExitCode {
+				t.Errorf("expected last_exit_code %q, got %v", tt.lastExitCode, fields["last_exit_code"])
+			}
+			if fields["has_run"] != tt.hasRun {
+				t.Errorf("expected has_run %v, got %v", tt.hasRun, fields["has_run"])
+			}
+		})
+	}
+}
+
+func TestHostnameIPv6(t *testing.T) {
+	tests := []struct {
+		address string
+		port    string
+	}{
+		{address: "http://[2001:db8::1]:8888", port: "8888"},
+		{address: "http://[2001:db8::1]", port: ""},
+	}
+	for _, tt := range tests {
+		s, err := newServer(ServerConfig{URL: tt.address})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hostname := s.hostname(); hostname != "2001:db8::1" {
+			t.Errorf("%s: expected hostname 2001:db8::1, got %q", tt.address, hostname)
+		}
+		if port := s.tags()["port"]; port != tt.port {
+			t.Errorf("%s: expected port tag %q, got %q", tt.address, tt.port, port)
+		}
+	}
+}
+
+func TestInvalidServerAddressReported(t *testing.T) {
+	ts := newTestServer(t, nil)
+	g := New(ts.URL, "http://[ereb")
+	g.Collectors = []string{"status"}
+
+	var acc testutil.Accumulator
+	if err := g.Gather(&acc); err != nil {
+		t.Fatal(err)
+	}
+	if len(acc.Errors) != 1 || !strings.Contains(acc.Errors[0].Error(), "Unable parse server address 'http://[ereb'") {
+		t.Errorf("expected the invalid address to be reported, got %v", acc.Errors)
+	}
+	if !acc.HasMeasurement("ereb_status") {
+		t.Error("the valid server was not gathered")
+	}
+}
+
+// basicAuthHandler serves body to requests authenticated as telegraf:secret.
+func basicAuthHandler(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "telegraf" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, body)
+	}
+}
+
+func TestServerCredentials(t *testing.T) {
+	ts := newTestServer(t, map[string]http.HandlerFunc{"/status": basicAuthHandler(statusFixture)})
+
+	inline := New("http://telegraf:secret@" + ts.Listener.Addr().String())
+	table := New()
+	table.ServerConfigs = []ServerConfig{{URL: ts.URL, Username: "telegraf", Password: config.NewSecret([]byte("secret"))}}
+
+	for name, g := range map[string]*Ereb{"servers": inline, "server table": table} {
+		t.Run(name, func(t *testing.T) {
+			g.Collectors = []string{"status"}
+
+			var acc testutil.Accumulator
+			if err := g.Gather(&acc); err != nil {
+				t.Fatal(err)
+			}
+			if err := acc.FirstError(); err != nil {
+				t.Fatal(err)
+			}
+			if !acc.HasMeasurement("ereb_status") {
+				t.Error("no ereb_status emitted")
+			}
+		})
+	}
+}
+
+func TestInitRejectsUnexpandedVariable(t *testing.T) {
+	for _, address := range []string{"${EREB_HOST}", "http://$EREB_HOST:8888"} {
+		g := New(address)
+		g.NetrcFile = "/nonexistent"
+		err := g.Init()
+		if err == nil || !strings.Contains(err.Error(), "unexpanded environment variable") {
+			t.Errorf("expected %q to be rejected, got %v", address, err)
+		}
+	}
+}
+
+func TestEnabledTasks(t *testing.T) {
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/tasks": fixture(`[
+			{"name": "backup", "task_id": "1", "enabled": true},
+			{"name": "cleanup", "task_id": "2", "enabled": true},
+			{"name": "report", "task_id": "3", "enabled": false}
+		]`),
+	})
+	g := New()
+
+	var acc testutil.Accumulator
+	if err := g.GatherCollector("status", ts.URL, &acc); err != nil {
+		t.Fatal(err)
+	}
+	m, ok := acc.Get("ereb_status")
+	if !ok {
+		t.Fatal("no ereb_status emitted")
+	}
+	if m.Fields["enabled_tasks"] != 2 || m.Tags["hostname"] != "127.0.0.1" {
+		t.Errorf("expected 2 enabled tasks for 127.0.0.1, got %v for %v", m.Fields["enabled_tasks"], m.Tags)
+	}
+}
+
+func TestCollectorsStatusOnly(t *testing.T) {
+	ts := newTestServer(t, nil)
+	g := New(ts.URL)
+	g.NetrcFile = "/nonexistent"
+	g.Collectors = []string{"status"}
+	if err := g.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var acc testutil.Accumulator
+	if err := g.Gather(&acc); err != nil {
+		t.Fatal(err)
+	}
+	if !acc.HasMeasurement("ereb_status") {
+		t.Error("no ereb_status emitted")
+	}
+	acc.AssertDoesNotContainMeasurement(t, "ereb_tasks")
+	acc.AssertDoesNotContainMeasurement(t, "ereb_groups")
+}
+
+func TestInitRejectsUnknownCollector(t *testing.T) {
+	g := New()
+	g.Collectors = []string{"status", "jobs"}
+	if err := g.Init(); err == nil || err.Error() != "Unknown collector 'jobs'" {
+		t.Errorf("expected the unknown collector to be rejected, got %v", err)
+	}
+}
+
+const enabledAndDisabledFixture = `[
+	{"name": "backup", "task_id": "1", "enabled": true},
+	{"name": "report", "task_id": "2", "enabled": false}
+]`
+
+func TestIncludeDisabledTasks(t *testing.T) {
+	g := New()
+	acc := gatherTasksFrom(t, g, enabledAndDisabledFixture)
+	if n := acc.NMetrics(); n != 2 {
+		t.Errorf("expected both tasks by default, got %d points", n)
+	}
+
+	g.IncludeDisabledTasks = false
+	acc = gatherTasksFrom(t, g, enabledAndDisabledFixture)
+	if n := acc.NMetrics(); n != 1 {
+		t.Fatalf("expected only the enabled task, got %d points", n)
+	}
+	taskFields(t, acc, "backup")
+}
+
+func TestLastRun(t *testing.T) {
+	lastRun := time.Now().Add(-time.Minute).Unix()
+	acc := gatherTasksFrom(t, New(), fmt.Sprintf(`[
+		{"name": "backup", "task_id": "1", "enabled": true, "stats": {"exit_codes": ["0"], "last_run": %d}},
+		{"name": "report", "task_id": "2", "enabled": true, "stats": {"exit_codes": []}}
+	]`, lastRun))
+
+	fields := taskFields(t, acc, "backup")
+	if fields["last_run"] != lastRun {
+		t.Errorf("expected last_run %d, got %v", lastRun, fields["last_run"])
+	}
+	if since := fields["seconds_since_last_run"].(float64); since < 60 || since > 120 {
+		t.Errorf("expected about a minute since the last run, got %v", since)
+	}
+
+	fields = taskFields(t, acc, "report")
+	if _, ok := fields["last_run"]; ok {
+		t.Error("last_run set for a task that never ran")
+	}
+	if fields["seconds_since_last_run"] != -1.0 {
+		t.Errorf("expected seconds_since_last_run -1, got %v", fields["seconds_since_last_run"])
+	}
+}
+
+func TestDuplicateTaskNames(t *testing.T) {
+	acc := gatherTasksFrom(t, New(), `[
+		{"name": "backup", "task_id": "1", "enabled": true},
+		{"name": "backup", "task_id": "2", "enabled": true},
+		{"name": "report", "task_id": "3", "enabled": true}
+	]`)
+
+	if n := acc.NMetrics(); n != 3 {
+		t.Fatalf("expected 3 points, got %d", n)
+	}
+	for _, taskTag := range []string{"backup_1", "backup_2", "report"} {
+		if fields := taskFields(t, acc, taskTag); fields["task_name"] != strings.SplitN(taskTag, "_", 2)[0] {
+			t.Errorf("unexpected task_name %v for %s", fields["task_name"], taskTag)
+		}
+	}
+}
+
+func TestErrorRatio(t *testing.T) {
+	tests := []struct {
+		errors  int
+		success int
+		ratio   float64
+	}{
+		{errors: 0, success: 0, ratio: 0},
+		{errors: 0, success: 10, ratio: 0},
+		{errors: 5, success: 10, ratio: 0.5},
+		// Only failures, there is no success to compare against
+		{errors: 5, success: 0, ratio: 0},
+	}
+	for _, tt := range tests {
+		acc := gatherTasksFrom(t, New(), fmt.Sprintf(`[{"name": "backup", "task_id": "1", "enabled": true, "stats": {"error": %d, "success": %d}}]`, tt.errors, tt.success))
+		if ratio := taskFields(t, acc, "backup")["error_ratio"]; ratio != tt.ratio {
+			t.Errorf("%d/%d: expected error_ratio %v, got %v", tt.errors, tt.success, tt.ratio, ratio)
+		}
+	}
+}
+
+func TestAuthError(t *testing.T) {
+	for _, code := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		ts := newTestServer(t, map[string]http.HandlerFunc{
+			"/status": func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(code)
+			},
+		})
+		g := New()
+		g.Collectors = []string{"status"}
+
+		var acc testutil.Accumulator
+		err := g.GatherCollector("status", ts.URL, &acc)
+		var authErr *AuthError
+		if !errors.As(err, &authErr) || authErr.Code != code {
+			t.Errorf("expected an *AuthError for %d, got %v", code, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), "check that credentials are configured and correct") {
+			t.Errorf("unexpected error message %q", err)
+		}
+	}
+}
+
+func TestBasePathFallback(t *testing.T) {
+	v2Requests := 0
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/api/v2/status": func(w http.ResponseWriter, r *http.Request) {
+			v2Requests++
+			http.NotFound(w, r)
+		},
+	})
+	g := New()
+	g.BasePaths = []string{"/api/v2", ""}
+	g.Collectors = []string{"status"}
+
+	for i := 0; i < 2; i++ {
+		var acc testutil.Accumulator
+		if err := g.GatherCollector("status", ts.URL, &acc); err != nil {
+			t.Fatal(err)
+		}
+		if !acc.HasMeasurement("ereb_status") {
+			t.Fatal("no ereb_status emitted")
+		}
+	}
+	// The legacy path is remembered after the first fallback
+	if v2Requests != 1 {
+		t.Errorf("expected a single request to the v2 path, got %d", v2Requests)
+	}
+}
+
+func TestGatherRunningTasks(t *testing.T) {
+	startedAt := time.Now().Add(-30 * time.Second).Unix()
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": fixture(fmt.Sprintf(`{
+			"next_run": 12.5,
+			"state": "running",
+			"running_task_runs": [
+				{"uuid": "r1", "task_id": "1", "name": "backup", "started_at": %d},
+				{"uuid": "r2", "task_id": "1", "name": "backup", "started_at": %d},
+				{"uuid": "r3", "task_id": "2", "name": "report"}
+			]
+		}`, startedAt, startedAt)),
+	})
+	g := New()
+	g.Collectors = []string{"status"}
+
+	var acc testutil.Accumulator
+	if err := g.GatherCollector("status", ts.URL, &acc); err != nil {
+		t.Fatal(err)
+	}
+
+	runs := map[string]map[string]interface{}{}
+	for _, m := range acc.Metrics {
+		if m.Measurement == "ereb_running_tasks" {
+			runs[m.Tags["task_tag"]+"/"+m.Tags["run_uuid"]] = m.Fields
+		}
+	}
+	if len(runs) != 3 {
+		t.Fatalf("expected 3 running task runs, got %v", runs)
+	}
+	if seconds, ok := runs["backup/r1"]["running_seconds"].(float64); !ok || seconds < 30 || seconds > 90 {
+		t.Errorf("unexpected running_seconds %v", runs["backup/r1"]["running_seconds"])
+	}
+	if _, ok := runs["report/r3"]["running_seconds"]; ok {
+		t.Error("running_seconds set for a run without started_at")
+	}
+}
+
+func TestNonNumericExitCodes(t *testing.T) {
+	for _, code := range []string{"SIGKILL", "-1", "137"} {
+		acc := gatherTasksFrom(t, New(), `[{"name": "backup", "task_id": "1", "enabled": true, "stats": {"exit_codes": ["0", "`+code+`"]}}]`)
+		fields := taskFields(t, acc, "backup")
+		if fields["last_exit_code"] != code {
+			t.Errorf("expected last_exit_code %q, got %v", code, fields["last_exit_code"])
+		}
+		if fields["last_errors_count"] != 1 {
+			t.Errorf("expected %s to count as a failure, got last_errors_count %v", code, fields["last_errors_count"])
+		}
+	}
+}
+
+func TestErrorThreshold(t *testing.T) {
+	tests := []struct {
+		threshold int64
+		unhealthy bool
+	}{
+		{threshold: -1, unhealthy: false},
+		{threshold: 2, unhealthy: true},
+		{threshold: 3, unhealthy: false},
+	}
+	for _, tt := range tests {
+		g := New()
+		g.ErrorThreshold = tt.threshold
+		acc := gatherTasksFrom(t, g, `[{"name": "backup", "task_id": "1", "enabled": true, "stats": {"error": 3}}]`)
+		if unhealthy := taskFields(t, acc, "backup")["unhealthy"]; unhealthy != tt.unhealthy {
+			t.Errorf("threshold %d: expected unhealthy %v, got %v", tt.threshold, tt.unhealthy, unhealthy)
+		}
+	}
+}
+
+func TestETagCache(t *testing.T) {
+	requests := 0
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/tasks": func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			fmt.Fprint(w, tasksFixture)
+		},
+	})
+	g := New()
+
+	for i := 0; i < 2; i++ {
+		var acc testutil.Accumulator
+		if err := g.GatherCollector("tasks", ts.URL, &acc); err != nil {
+			t.Fatal(err)
+		}
+		if fields := taskFields(t, &acc, "backup"); fields["success_count"] != int64(4) {
+			t.Errorf("gather %d: unexpected success_count %v", i, fields["success_count"])
+		}
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+}
+
+func TestOverdueSeconds(t *testing.T) {
+	lastRun := time.Date(2024, 1, 1, 10, 0, 0, 0, time.Local)
+	tests := []struct {
+		schedule string
+		now      time.Time
+		overdue  float64
+		ok       bool
+	}{
+		{schedule: "0 * * * *", now: lastRun.Add(150 * time.Minute), overdue: 5400, ok: true},
+		{schedule: "*/15 * * * *", now: lastRun.Add(10 * time.Minute), overdue: 0, ok: true},
+		{schedule: "0 3 * * *", now: lastRun.Add(24 * time.Hour), overdue: 7 * 3600, ok: true},
+		{schedule: "", now: lastRun, ok: false},
+		{schedule: "not a schedule", now: lastRun, ok: false},
+	}
+	for _, tt := range tests {
+		overdue, ok := overdueSeconds(tt.schedule, float64(lastRun.Unix()), tt.now)
+		if overdue != tt.overdue || ok != tt.ok {
+			t.Errorf("%q: expected %v, %v, got %v, %v", tt.schedule, tt.overdue, tt.ok, overdue, ok)
+		}
+	}
+}
+
+func TestGatherLongestIdleTask(t *testing.T) {
+	lastRun := time.Now().Add(-3 * time.Hour).Unix()
+	recentRun := time.Now().Add(-90 * time.Minute).Unix()
+	acc := gatherTasksFrom(t, New(), fmt.Sprintf(`[
+		{"name": "hourly", "task_id": "1", "enabled": true, "cron_schedule": "0 * * * *", "stats": {"last_run": %d}},
+		{"name": "recent", "task_id": "2", "enabled": true, "cron_schedule": "0 * * * *", "stats": {"last_run": %d}}
+	]`, lastRun, recentRun))
+
+	m, ok := acc.Get("ereb_longest_idle_task")
+	if !ok {
+		t.Fatal("no ereb_longest_idle_task emitted")
+	}
+	if m.Tags["task_tag"] != "hourly" || m.Fields["task_name"] != "hourly" {
+		t.Errorf("expected the hourly task to be the longest idle, got %v", m.Tags)
+	}
+	if idle := m.Fields["idle_seconds"].(float64); idle <= 3600 || idle > 3*3600 {
+		t.Errorf("unexpected idle_seconds %v", idle)
+	}
+}
+
+func TestNullDurations(t *testing.T) {
+	acc := gatherTasksFrom(t, New(), `[
+		{"name": "never", "task_id": "1", "enabled": true, "stats": {"duration_avg": null, "duration_max": null, "duration_min": null}},
+		{"name": "instant", "task_id": "2", "enabled": true, "stats": {"duration_avg": 0, "duration_max": 0, "duration_min": 0}}
+	]`)
+
+	never := taskFields(t, acc, "never")
+	for _, field := range []string{"avg_duration_ms", "max_duration_ms", "min_duration_ms", "avg_duration", "max_duration", "min_duration"} {
+		if _, ok := never[field]; ok {
+			t.Errorf("%s set for a null duration", field)
+		}
+	}
+
+	instant := taskFields(t, acc, "instant")
+	if instant["avg_duration_ms"] != 0.0 || instant["avg_duration"] != 0.0 || instant["max_duration"] != int64(0) {
+		t.Errorf("expected zero durations, got %v", instant)
+	}
+}
+
+func TestRecentExitCodeFields(t *testing.T) {
+	g := New()
+	g.RecentExitCodeFields = 3
+	acc := gatherTasksFrom(t, g, `[{"name": "backup", "task_id": "1", "enabled": true, "stats": {"exit_codes": ["0", "1", "2", "3", "4"]}}]`)
+
+	fields := taskFields(t, acc, "backup")
+	for field, code := range map[string]string{"exit_code_0": "4", "exit_code_1": "3", "exit_code_2": "2"} {
+		if fields[field] != code {
+			t.Errorf("expected %s %q, got %v", field, code, fields[field])
+		}
+	}
+	if _, ok := fields["exit_code_3"]; ok {
+		t.Error("more than 3 exit code fields emitted")
+	}
+}
+
+func TestBasicAuthFromURL(t *testing.T) {
+	ts := newTestServer(t, map[string]http.HandlerFunc{"/tasks": basicAuthHandler(tasksFixture)})
+	g := New()
+
+	var acc testutil.Accumulator
+	address := "http://telegraf:secret@" + ts.Listener.Addr().String() + "/"
+	if err := g.GatherCollector("tasks", address, &acc); err != nil {
+		t.Fatal(err)
+	}
+	taskFields(t, &acc, "backup")
+}
+
+func TestRetrying(t *testing.T) {
+	tests := []struct {
+		name           string
+		tryMoreOnError bool
+		errors         int
+		exitCodes      string
+		retrying       bool
+	}{
+		{name: "recovering", tryMoreOnError: true, errors: 2, exitCodes: `["1", "0"]`, retrying: true},
+		{name: "failing", tryMoreOnError: true, errors: 2, exitCodes: `["0", "1"]`, retrying: false},
+		{name: "no errors", tryMoreOnError: true, errors: 0, exitCodes: `["0"]`, retrying: false},
+		{name: "no retries", tryMoreOnError: false, errors: 2, exitCodes: `["1", "0"]`, retrying: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acc := gatherTasksFrom(t, New(), fmt.Sprintf(`[{"name": "backup", "task_id": "1", "enabled": true, "try_more_on_error": %v, "stats": {"error": %d, "exit_codes": %s}}]`, tt.tryMoreOnError, tt.errors, tt.exitCodes))
+			if retrying := taskFields(t, acc, "backup")["retrying"]; retrying != tt.retrying {
+				t.Errorf("expected retrying %v, got %v", tt.retrying, retrying)
+			}
+		})
+	}
+}
+
+func TestServerTimeout(t *testing.T) {
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprint(w, statusFixture)
+	}
+	short := newTestServer(t, map[string]http.HandlerFunc{"/status": slow})
+	long := newTestServer(t, map[string]http.HandlerFunc{"/status": slow})
+
+	g := New()
+	g.Collectors = []string{"status"}
+	g.Timeout = config.Duration(time.Second)
+	g.ServerConfigs = []ServerConfig{
+		{URL: short.URL, Timeout: config.Duration(20 * time.Millisecond)},
+		{URL: long.URL},
+	}
+
+	var acc testutil.Accumulator
+	if err := g.Gather(&acc); err != nil {
+		t.Fatal(err)
+	}
+	if len(acc.Errors) != 1 || !strings.Contains(acc.Errors[0].Error(), short.URL) {
+		t.Errorf("expected only the server with the short timeout to fail, got %v", acc.Errors)
+	}
+	if n := acc.NMetrics(); n != 1 {
+		t.Errorf("expected ereb_status of the other server, got %d points", n)
+	}
+}
+
+func TestTaskChanges(t *testing.T) {
+	tasks := `[{"name": "backup", "task_id": "1"}, {"name": "report", "task_id": "2"}]`
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/tasks": func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, tasks)
+		},
+	})
+	g := New()
+
+	gather := func() map[string]interface{} {
+		t.Helper()
+		var acc testutil.Accumulator
+		if err := g.GatherCollector("status", ts.URL, &acc); err != nil {
+			t.Fatal(err)
+		}
+		m, ok := acc.Get("ereb_status")
+		if !ok {
+			t.Fatal("no ereb_status emitted")
+		}
+		return m.Fields
+	}
+
+	if fields := gather(); fields["tasks_added"] != 0 || fields["tasks_removed"] != 0 {
+		t.Errorf("expected no changes on the first gather, got %v added, %v removed", fields["tasks_added"], fields["tasks_removed"])
+	}
+
+	tasks = `[{"name": "report", "task_id": "2"}, {"name": "cleanup", "task_id": "3"}, {"name": "sync", "task_id": "4"}]`
+	if fields := gather(); fields["tasks_added"] != 2 || fields["tasks_removed"] != 1 {
+		t.Errorf("expected 2 added and 1 removed, got %v added, %v removed", fields["tasks_added"], fields["tasks_removed"])
+	}
+}
+
+func TestRequireStats(t *testing.T) {
+	g := New()
+	g.RequireStats = true
+	acc := gatherTasksFrom(t, g, `[
+		{"name": "backup", "task_id": "1", "enabled": true, "stats": {"exit_codes": ["0"]}},
+		{"name": "new", "task_id": "2", "enabled": true, "stats": {"exit_codes": []}}
+	]`)
+
+	if n := acc.NMetrics(); n != 1 {
+		t.Fatalf("expected only the task that ran, got %d points", n)
+	}
+	taskFields(t, acc, "backup")
+}
+
+func TestTrailingSlash(t *testing.T) {
+	tests := []struct {
+		address  string
+		endpoint string
+	}{
+		{address: "http://ereb:8888/", endpoint: "http://ereb:8888/status"},
+		{address: "http://ereb:8888/ereb/?token=abc", endpoint: "http://ereb:8888/ereb/status?token=abc"},
+		{address: "http://ereb:8888/ereb//", endpoint: "http://ereb:8888/ereb//status"},
+		{address: "http://ereb:8888/a%2Fb/?x=1&y=2", endpoint: "http://ereb:8888/a%2Fb/status?x=1&y=2"},
+	}
+	for _, tt := range tests {
+		s, err := newServer(ServerConfig{URL: tt.address})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if endpoint := s.endpoint("/status").String(); endpoint != tt.endpoint {
+			t.Errorf("%s: expected %s, got %s", tt.address, tt.endpoint, endpoint)
+		}
+	}
+}
+
+func TestTrailingSlashKeepsQuery(t *testing.T) {
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("token") != "abc" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, statusFixture)
+		},
+	})
+	g := New()
+	g.Collectors = []string{"status"}
+
+	var acc testutil.Accumulator
+	if err := g.GatherCollector("status", ts.URL+"/?token=abc", &acc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGatherFailureLogsEscapesTaskID(t *testing.T) {
+	var requested string
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/tasks": fixture(`[{"name": "backup", "task_id": "daily/1", "enabled": true, "stats": {"exit_codes": ["1"]}}]`),
+		"/tasks/": func(w http.ResponseWriter, r *http.Request) {
+			requested = r.URL.EscapedPath()
+			fmt.Fprint(w, "failed")
+		},
+	})
+	g := New(ts.URL)
+	g.Collectors = []string{"tasks"}
+	g.FailureLogs = true
+
+	var acc testutil.Accumulator
+	if err := g.Gather(&acc); err != nil {
+		t.Fatal(err)
+	}
+	if requested != "/tasks/daily%2F1/last_run/log" {
+		t.Errorf("unexpected log path %q", requested)
+	}
+}
+
+func TestVersionTag(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  string
+		version string
+	}{
+		{name: "reported", status: `{"state": "running", "version": "2.4.1"}`, version: "2.4.1"},
+		{name: "older server", status: `{"state": "running"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, map[string]http.HandlerFunc{"/status": fixture(tt.status)})
+			g := New()
+			g.VersionTag = true
+			g.VersionTagTasks = true
+
+			var acc testutil.Accumulator
+			for _, collector := range []string{"status", "tasks"} {
+				if err := g.GatherCollector(collector, ts.URL, &acc); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, measurement := range []string{"ereb_status", "ereb_tasks"} {
+				if acc.HasTag(measurement, "version") != (tt.version != "") || acc.TagValue(measurement, "version") != tt.version {
+					t.Errorf("expected version %q on %s, got %q", tt.version, measurement, acc.TagValue(measurement, "version"))
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyTasks(t *testing.T) {
+	ts := newTestServer(t, map[string]http.HandlerFunc{"/tasks": fixture(`[]`)})
+	g := New()
+
+	var acc testutil.Accumulator
+	for _, collector := range []string{"status", "tasks"} {
+		if err := g.GatherCollector(collector, ts.URL, &acc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, ok := acc.Get("ereb_status")
+	if !ok || m.Fields["tasks_seen"] != 0 {
+		t.Errorf("expected tasks_seen 0, got %v", m)
+	}
+	acc.AssertDoesNotContainMeasurement(t, "ereb_tasks")
+}
+
+func TestDefaultServer(t *testing.T) {
+	ts := newTestServer(t, nil)
+	g := New()
+	g.DefaultServer = ts.URL
+	g.Collectors = []string{"status"}
+
+	var acc testutil.Accumulator
+	if err := g.Gather(&acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := acc.FirstError(); err != nil {
+		t.Fatal(err)
+	}
+	if !acc.HasMeasurement("ereb_status") {
+		t.Error("default_server was not gathered")
+	}
+}
+
+func TestExitCodeHistoryLen(t *testing.T) {
+	acc := gatherTasksFrom(t, New(), `[
+		{"name": "backup", "task_id": "1", "enabled": true, "stats": {"exit_codes": ["0", "1", "0", "None"]}},
+		{"name": "new", "task_id": "2", "enabled": true, "stats": {"exit_codes": []}}
+	]`)
+	if n := taskFields(t, acc, "backup")["exit_code_history_len"]; n != 4 {
+		t.Errorf("expected exit_code_history_len 4, got %v", n)
+	}
+	if n := taskFields(t, acc, "new")["exit_code_history_len"]; n != 0 {
+		t.Errorf("expected exit_code_history_len 0, got %v", n)
+	}
+}
+
+func TestRequestMethodAndBody(t *testing.T) {
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if r.Method != "POST" || string(body) != `{"scope": "status"}` || r.Header.Get("Content-Type") != "application/json" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, statusFixture)
+		},
+	})
+	g := New()
+	g.Collectors = []string{"status"}
+	g.RequestMethod = "POST"
+	g.RequestBody = `{"scope": "status"}`
+
+	var acc testutil.Accumulator
+	if err := g.GatherCollector("status", ts.URL, &acc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNextFireAt(t *testing.T) {
+	acc := gatherTasksFrom(t, New(), `[
+		{"name": "hourly", "task_id": "1", "enabled": true, "cron_schedule": "0 * * * *"},
+		{"name": "broken", "task_id": "2", "enabled": true, "cron_schedule": "every hour"},
+		{"name": "manual", "task_id": "3", "enabled": true, "cron_schedule": ""},
+		{"name": "disabled", "task_id": "4", "enabled": false, "cron_schedule": "0 * * * *"}
+	]`)
+
+	next, ok := taskFields(t, acc, "hourly")["next_fire_at"].(int64)
+	if until := time.Until(time.Unix(next, 0)); !ok || until <= 0 || until > time.Hour {
+		t.Errorf("expected a next_fire_at within the hour, got %v", next)
+	}
+	for _, taskTag := range []string{"broken", "manual", "disabled"} {
+		if _, ok := taskFields(t, acc, taskTag)["next_fire_at"]; ok {
+			t.Errorf("next_fire_at set for %s", taskTag)
+		}
+	}
+}
+
+func TestDurationPercentiles(t *testing.T) {
+	acc := gatherTasksFrom(t, New(), `[
+		{"name": "backup", "task_id": "1", "enabled": true, "stats": {"duration_p50": 1.5, "duration_p95": 4, "duration_p99": 7.25}},
+		{"name": "older", "task_id": "2", "enabled": true, "stats": {}}
+	]`)
+
+	fields := taskFields(t, acc, "backup")
+	for field, value := range map[string]float64{"duration_p50": 1.5, "duration_p95": 4, "duration_p99": 7.25} {
+		if fields[field] != value {
+			t.Errorf("expected %s %v, got %v", field, value, fields[field])
+		}
+	}
+	fields = taskFields(t, acc, "older")
+	for _, field := range []string{"duration_p50", "duration_p95", "duration_p99"} {
+		if _, ok := fields[field]; ok {
+			t.Errorf("%s set without a percentile reported", field)
+		}
+	}
+}
+
+func TestErrorsHidePassword(t *testing.T) {
+	failing := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "broken", http.StatusInternalServerError)
+		},
+	})
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	g := New(
+		"http://telegraf:hunter2@"+failing.Listener.Addr().String(),
+		"http://telegraf:hunter2@"+down.Listener.Addr().String(),
+		"http://telegraf:hunter2@[ereb",
+	)
+	g.Collectors = []string{"status"}
+	g.debug_mode = true
+
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	var acc testutil.Accumulator
+	if err := g.Gather(&acc); err != nil {
+		t.Fatal(err)
+	}
+	if len(acc.Errors) != 3 {
+		t.Fatalf("expected an error per server, got %v", acc.Errors)
+	}
+	for _, err := range acc.Errors {
+		if strings.Contains(err.Error(), "hunter2") {
+			t.Errorf("password in error %q", err)
+		}
+	}
+	if strings.Contains(logs.String(), "hunter2") {
+		t.Errorf("password in debug log %q", logs.String())
+	}
+}
+
+func TestTasksPayloadShapes(t *testing.T) {
+	tests := []struct {
+		name  string
+		tasks string
+		count interface{}
+	}{
+		{name: "bare", tasks: `[{"name": "backup", "task_id": "1"}]`},
+		{name: "wrapped", tasks: `{"tasks": [{"name": "backup", "task_id": "1"}], "count": 1}`, count: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, map[string]http.HandlerFunc{"/tasks": fixture(tt.tasks)})
+			g := New()
+
+			var acc testutil.Accumulator
+			for _, collector := range []string{"status", "tasks"} {
+				if err := g.GatherCollector(collector, ts.URL, &acc); err != nil {
+					t.Fatal(err)
+				}
+			}
+			taskFields(t, &acc, "backup")
+
+			m, ok := acc.Get("ereb_status")
+			if !ok {
+				t.Fatal("no ereb_status emitted")
+			}
+			if count := m.Fields["tasks_count"]; count != tt.count {
+				t.Errorf("expected tasks_count %v, got %v", tt.count, count)
+			}
+		})
+	}
+}
+
+func TestUseServerTime(t *testing.T) {
+	generatedAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": fixture(fmt.Sprintf(`{"state": "running", "generated_at": %d}`, generatedAt.Unix())),
+	})
+
+	for _, useServerTime := range []bool{false, true} {
+		g := New()
+		g.UseServerTime = useServerTime
+
+		var acc testutil.Accumulator
+		for _, collector := range []string{"status", "tasks"} {
+			if err := g.GatherCollector(collector, ts.URL, &acc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, m := range acc.Metrics {
+			if m.Time.Equal(generatedAt) != useServerTime {
+				t.Errorf("use_server_time %v: unexpected time %s of %s", useServerTime, m.Time, m.Measurement)
+			}
+		}
+	}
+}
+
+// realmHandler challenges requests for basic auth in realm, serving body to
+// those authenticated as telegraf:secret.
+func realmHandler(realm string, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "telegraf" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, body)
+	}
+}
+
+func TestRealmCredentials(t *testing.T) {
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": realmHandler("status", statusFixture),
+		"/tasks":  realmHandler("tasks", tasksFixture),
+	})
+	g := New()
+	g.RealmCredentials = map[string]RealmCredentials{
+		"status": {Username: "telegraf", Password: config.NewSecret([]byte("secret"))},
+	}
+
+	var acc testutil.Accumulator
+	if err := g.GatherCollector("status", ts.URL, &acc); err != nil {
+		t.Fatal(err)
+	}
+
+	err := g.GatherCollector("tasks", ts.URL, &acc)
+	var authErr *AuthError
+	if !errors.As(err, &authErr) || authErr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the 401 of a realm without credentials, got %v", err)
+	}
+}
+
+func TestRequireServersIgnoresDefault(t *testing.T) {
+	g := New()
+	g.DefaultServer = "http://ereb:8888"
+	g.RequireServers = true
+
+	var acc testutil.Accumulator
+	if err := g.Gather(&acc); err != errNoServers {
+		t.Errorf("expected errNoServers, got %v", err)
+	}
+}
+
+func TestRequireServers(t *testing.T) {
+	g := New()
+	g.RequireServers = true
+	g.NetrcFile = "/nonexistent"
+	if err := g.Init(); err != errNoServers {
+		t.Errorf("expected errNoServers from Init, got %v", err)
+	}
+
+	g = New()
+	g.RequireServers = true
+	g.ServersFile = t.TempDir() + "/servers"
+	if err := os.WriteFile(g.ServersFile, []byte("# none yet\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var acc testutil.Accumulator
+	if err := g.Gather(&acc); err != errNoServers {
+		t.Errorf("expected errNoServers for an empty servers_file, got %v", err)
+	}
+}
+
+func TestNetrcFile(t *testing.T) {
+	ts := newTestServer(t, map[string]http.HandlerFunc{"/status": basicAuthHandler(statusFixture)})
+
+	tests := []struct {
+		name  string
+		netrc string
+		fails bool
+	}{
+		{name: "machine", netrc: "machine other login nobody password nothing\nmachine 127.0.0.1 login telegraf password secret\n"},
+		{name: "default", netrc: "machine other login nobody password nothing\ndefault login telegraf password secret\n"},
+		{name: "missing entry", netrc: "machine other login telegraf password secret\n", fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := New(ts.URL)
+			g.Collectors = []string{"status"}
+			g.NetrcFile = t.TempDir() + "/netrc"
+			if err := os.WriteFile(g.NetrcFile, []byte(tt.netrc), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := g.Init(); err != nil {
+				t.Fatal(err)
+			}
+
+			var acc testutil.Accumulator
+			err := g.GatherCollector("status", ts.URL, &acc)
+			var authErr *AuthError
+			if tt.fails && !errors.As(err, &authErr) {
+				t.Errorf("expected the request to go without credentials, got %v", err)
+			}
+			if !tt.fails && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestNextRunImminent(t *testing.T) {
+	tests := []struct {
+		window   time.Duration
+		imminent int
+	}{
+		{window: time.Minute, imminent: 0},
+		{window: 2 * time.Minute, imminent: 2},
+		{window: 0, imminent: 0},
+	}
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": fixture(`{"next_run": 90, "state": "running", "next_tasks": [{"name": "backup"}, {"name": "report"}]}`),
+	})
+	for _, tt := range tests {
+		g := New()
+		g.Collectors = []string{"status"}
+		g.ImminentWindow = config.Duration(tt.window)
+
+		var acc testutil.Accumulator
+		if err := g.GatherCollector("status", ts.URL, &acc); err != nil {
+			t.Fatal(err)
+		}
+		m, _ := acc.Get("ereb_status")
+		if imminent := m.Fields["next_run_imminent"]; imminent != tt.imminent {
+			t.Errorf("window %s: expected next_run_imminent %d, got %v", tt.window, tt.imminent, imminent)
+		}
+	}
+}
+
+func TestNextRunStalled(t *testing.T) {
+	nextRun := 30
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"next_run": %d, "state": "running"}`, nextRun)
+		},
+	})
+	g := New()
+	g.Collectors = []string{"status"}
+	g.StallThreshold = 2
+
+	// next_run stays frozen from the first gather on, then advances
+	nextRuns := []int{30, 30, 30, 30, 25}
+	stalled := []bool{false, false, true, true, false}
+	for i := range nextRuns {
+		nextRun = nextRuns[i]
+		var acc testutil.Accumulator
+		if err := g.GatherCollector("status", ts.URL, &acc); err != nil {
+			t.Fatal(err)
+		}
+		m, _ := acc.Get("ereb_status")
+		if m.Fields["next_run_stalled"] != stalled[i] {
+			t.Errorf("gather %d: expected next_run_stalled %v, got %v", i, stalled[i], m.Fields["next_run_stalled"])
+		}
+	}
+}
+
+func TestShellScripts(t *testing.T) {
+	tests := []struct {
+		name    string
+		scripts string
+		count   int
+		names   string
+	}{
+		{name: "strings", scripts: `["backup.sh", "upload.sh"]`, count: 2, names: "backup.sh,upload.sh"},
+		{name: "objects", scripts: `[{"name": "backup.sh", "enabled": true}, {"name": "upload.sh", "enabled": false}, {"script": "notify.sh"}]`, count: 2, names: "backup.sh,notify.sh"},
+		{name: "mixed", scripts: `["backup.sh", {"name": "upload.sh", "enabled": false}]`, count: 1, names: "backup.sh"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acc := gatherTasksFrom(t, New(), `[{"name": "backup", "task_id": "1", "enabled": true, "shell_scripts": `+tt.scripts+`}]`)
+			fields := taskFields(t, acc, "backup")
+			if fields["enabled_scripts_count"] != tt.count || fields["enabled_scripts"] != tt.names {
+				t.Errorf("expected %d enabled scripts %q, got %v %q", tt.count, tt.names, fields["enabled_scripts_count"], fields["enabled_scripts"])
+			}
+		})
+	}
+}
+
+func TestDurationSummaryField(t *testing.T) {
+	g := New()
+	g.DurationSummaryField = true
+	acc := gatherTasksFrom(t, g, `[
+		{"name": "backup", "task_id": "1", "enabled": true, "stats": {"duration_avg": 1.5, "duration_max": 2, "duration_min": 1}},
+		{"name": "partial", "task_id": "2", "enabled": true, "stats": {"duration_avg": 0.25}},
+		{"name": "never", "task_id": "3", "enabled": true, "stats": {}}
+	]`)
+
+	if summary := taskFields(t, acc, "backup")["duration_summary"]; summary != "min=1000,avg=1500,max=2000" {
+		t.Errorf("unexpected duration_summary %q", summary)
+	}
+	if summary := taskFields(t, acc, "partial")["duration_summary"]; summary != "avg=250" {
+		t.Errorf("unexpected duration_summary %q", summary)
+	}
+	if _, ok := taskFields(t, acc, "never")["duration_summary"]; ok {
+		t.Error("duration_summary set without durations")
+	}
+	// The individual fields are kept
+	if taskFields(t, acc, "backup")["avg_duration_ms"] != 1500.0 {
+		t.Error("avg_duration_ms missing along with duration_summary")
+	}
+}
+
+func TestServersSharingHost(t *testing.T) {
+	up := newTestServer(t, nil)
+	down := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+	})
+	g := New(up.URL, down.URL)
+	g.HealthCheckOnly = true
+
+	var acc testutil.Accumulator
+	if err := g.Gather(&acc); err != nil {
+		t.Fatal(err)
+	}
+	acc.AssertContainsTaggedFields(t, "ereb_status", map[string]interface{}{"ereb_up": 1}, serverTags(up, nil))
+	acc.AssertContainsTaggedFields(t, "ereb_status", map[string]interface{}{"ereb_up": 0}, serverTags(down, nil))
+}
+
+func TestPortTag(t *testing.T) {
+	tests := []struct {
+		address string
+		port    string
+	}{
+		{address: "http://ereb:8888", port: "8888"},
+		{address: "http://ereb:8889/ereb", port: "8889"},
+		{address: "http://ereb", port: ""},
+		{address: "http://ereb:80", port: ""},
+		{address: "https://ereb:443", port: ""},
+		{address: "https://ereb:80", port: "80"},
+		{address: "unix:///var/run/ereb.sock", port: ""},
+	}
+	for _, tt := range tests {
+		s, err := newServer(ServerConfig{URL: tt.address})
+		if err != nil {
+			t.Fatal(err)
+		}
+		port, ok := s.tags()["port"]
+		if port != tt.port || ok != (tt.port != "") {
+			t.Errorf("%s: expected port tag %q, got %q", tt.address, tt.port, port)
+		}
+	}
+}
+
+func TestNetrcFileUnreadable(t *testing.T) {
+	// A directory cannot be read as a netrc file
+	home := t.TempDir()
+	if err := os.Mkdir(home+"/.netrc", 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", home)
+
+	g := New("http://ereb:8888")
+	if err := g.Init(); err != nil {
+		t.Errorf("expected the implicit netrc file to be ignored, got %v", err)
+	}
+
+	g = New("http://ereb:8888")
+	g.NetrcFile = home + "/.netrc"
+	if err := g.Init(); err == nil || !strings.Contains(err.Error(), "Unable to read netrc file") {
+		t.Errorf("expected the configured netrc file to fail Init, got %v", err)
+	}
+}
+
+func TestUnixSocketWithCustomClient(t *testing.T) {
+	ts := newTestServer(t, nil)
+
+	g := New(ts.URL, "unix:///var/run/ereb.sock")
+	g.Client = ts.Client()
+	g.NetrcFile = "/nonexistent"
+	if err := g.Init(); err == nil || !strings.Contains(err.Error(), "with a custom Client") {
+		t.Errorf("expected the Unix socket server to be rejected, got %v", err)
+	}
+
+	g.Collectors = []string{"status"}
+	var acc testutil.Accumulator
+	if err := g.Gather(&acc); err != nil {
+		t.Fatal(err)
+	}
+	if len(acc.Errors) != 1 || !strings.Contains(acc.Errors[0].Error(), "Unable to gather from Unix socket server 'unix:///var/run/ereb.sock'") {
+		t.Errorf("expected the Unix socket server to be reported, got %v", acc.Errors)
+	}
+	if !acc.HasMeasurement("ereb_status") {
+		t.Error("expected the other server to be gathered through the custom client")
+	}
+}
+
+func TestInstancesDoNotShareServers(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	ts := newTestServer(t, map[string]http.HandlerFunc{
+		"/status": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requests[r.URL.Query().Get("instance")]++
+			mu.Unlock()
+			fmt.Fprint(w, statusFixture)
+		},
+	})
+
+	a := New(ts.URL + "/?instance=a")
+	a.Collectors = []string{"status"}
+	b := New()
+	b.DefaultServer = ts.URL + "/?instance=b"
+	b.Collectors = []string{"status"}
+
+	const gathers = 3
+	accs := make([]testutil.Accumulator, 2*gathers)
+	var wg sync.WaitGroup
+	for i := 0; i < gathers; i++ {
+		for j, g := range []*Ereb{a, b} {
+			wg.Add(1)
+			go func(g *Ereb, acc *testutil.Accumulator) {
+				defer wg.Done()
+				if err := g.Gather(acc); err != nil {
+					t.Error(err)
+				}
+			}(g, &accs[2*i+j])
+		}
+	}
+	wg.Wait()
+
+	if requests["a"] != gathers || requests["b"] != gathers || len(requests) != 2 {
+		t.Errorf("expected %d requests from each instance, got %v", gathers, requests)
+	}
+	for i := range accs {
+		if n := len(accs[i].Metrics); n != 1 || accs[i].Metrics[0].Measurement != "ereb_status" {
+			t.Errorf("expected a single ereb_status per gather, got %d metrics", n)
+		}
+	}
+	if len(a.Servers) != 1 || len(b.Servers) != 0 {
+		t.Errorf("expected the configured servers to be left as is, got %v and %v", a.Servers, b.Servers)
+	}
+}